@@ -1,39 +1,399 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/donjaime/tomato"
 )
 
+// Repeatable -target flag of the form lang:outfile.
+type targetList []string
+
+func (t *targetList) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *targetList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return errors.New("target must be of the form lang:outfile")
+	}
+	*t = append(*t, value)
+	return nil
+}
+
 func main() {
-	tomatoIn := flag.String("tomatoIn", "views", "the folder to use as the tomato input root folder")
+	tomatoIn := flag.String("tomatoIn", "views", "the folder to use as the tomato input root folder, or a single template to generate along with its nested tomatos")
 	tomatoOut := flag.String("tomatoOut", "gen/views.ts", "the output file to emit generated tomato views to")
-	language := flag.String("language", "ts", "what language to use for the generated tomato views")
+	language := flag.String("language", "ts", "what language to use for the generated tomato views (ts, html to write the normalized templates, or h for hyperscript functions)")
 	viewBaseClass := flag.String("view", "View", "name of view base class")
 	viewFactory := flag.String("factory", "createView", "function that instantiates a view")
 	importLocation := flag.String("importLocation", "../ts/src/view", "where to find the view library")
 	forceDebugIds := flag.Bool("debugIds", false, "whether or not to force generated Views to have debug-ids")
+	debugIdAttr := flag.String("debugIdAttr", "debug-id", "attribute forced debug-ids are set on")
+	normalizeNewlines := flag.Bool("lf", false, "whether or not to force LF line endings in the generated files")
+	trailingNewline := flag.Bool("trailingNewline", false, "whether or not to end the generated files with exactly one newline")
+	hydrate := flag.Bool("hydrate", false, "whether or not to emit hydrate methods that wire refs from an existing DOM")
+	classModule := flag.String("classModule", "", "CSS module to map class attribute values through (empty disables)")
+	verbose := flag.Bool("v", false, "whether or not to log every generated file")
+	quiet := flag.Bool("quiet", false, "whether or not to suppress everything but errors")
+	statements := flag.Bool("statements", false, "whether or not to emit DOM construction as a statement per element")
+	bulkAttrs := flag.Bool("bulkAttrs", false, "whether or not to set each element's attributes with a single setAttrs call")
+	specialPrefix := flag.String("specialPrefix", "_", "prefix of the special template attributes (_ref, _id, ...)")
+	fragmentThreshold := flag.Int("fragmentThreshold", 0, "build elements with at least this many children in a DocumentFragment (0 disables)")
+	scaffoldDir := flag.String("scaffoldDir", "", "generate Base views and scaffold developer owned subclasses into this folder")
+	inlineThreshold := flag.Int("inlineThreshold", 0, "inline nested tomatos with at most this many elements (0 disables)")
+	lintAria := flag.Bool("lintAria", false, "whether or not to check elements against a set of ARIA rules")
+	strict := flag.Bool("strict", false, "whether or not to treat warnings as errors")
+	mockTodos := flag.Bool("mockTodos", false, "whether or not to leave TODO comments on _ignorecontent elements")
+	splitConstruction := flag.Bool("splitConstruction", false, "whether or not to build each child of the root in its own private method")
+	textRootTag := flag.String("textRootTag", "", "element to wrap text only templates in (empty makes them an error)")
+	assetBaseURL := flag.String("assetBaseURL", "", "public URL to rewrite relative asset src/href values to (empty disables)")
+	assetRoot := flag.String("assetRoot", "", "folder whose contents are served at -assetBaseURL (defaults to the working directory)")
+	registry := flag.Bool("registry", false, "whether or not to emit a map from view tags to view classes")
+	splitStyles := flag.Bool("splitStyles", false, "whether or not to set inline styles a property at a time")
+	attrTypes := flag.Bool("attrTypes", false, "whether or not to check the values of common numeric and boolean attributes, leaving out booleans set to \"false\"")
+	documentParsing := flag.Bool("documentParsing", false, "whether or not to parse templates as whole documents rather than fragments")
+	tagRoot := flag.Bool("tagRoot", false, "whether or not to set a data-view attribute naming the view on every root")
+	prologue := flag.String("prologue", "", "code to run in every constructor right after super ({{view}} is the view name)")
+	epilogue := flag.String("epilogue", "", "code to run at the end of every constructor ({{view}} is the view name)")
+	sortOrder := flag.String("sort", "path", "order to write views in: path, directory or name")
+	tagFactories := flag.String("tagFactories", "", "comma separated tag=factory pairs of functions creating those tags' elements")
+	allowedAttrs := flag.String("allowedAttrs", "", "comma separated attributes to keep, dropping all others (* matches any suffix)")
+	deniedAttrs := flag.String("deniedAttrs", "", "comma separated attributes to drop (* matches any suffix)")
+	debugRefs := flag.Bool("debugRefs", false, "whether or not to emit a map from debug-ids to ref names on each view")
+	reexportBase := flag.Bool("reexportBase", false, "whether or not to re-export the view base class and factory from the generated files")
+	maxWrapperDepth := flag.Int("maxWrapperDepth", 0, "warn about chains of more than this many nested single child wrapper elements (0 disables)")
+	hmr := flag.Bool("hmr", false, "whether or not to end the generated files with hot module replacement boilerplate")
+	hotAccept := flag.String("hotAccept", "", "hot module replacement code to end the generated files with (defaults to accepting through import.meta.hot)")
+	cloneStrategy := flag.Bool("clone", false, "whether or not to construct views by cloning a template built by the first instance")
+	lineComments := flag.Bool("lineComments", false, "whether or not to comment each element's construction with its template file and line")
+	classNames := flag.Bool("classNames", false, "whether or not to emit a map of the class names used by each view")
+	strictMarkup := flag.Bool("strictMarkup", false, "whether or not to check templates for unknown tags and mismatched end tags")
+	optionsConstructor := flag.Bool("optionsConstructor", false, "whether or not views take their _props in an options object")
+	includes := flag.Bool("includes", false, "whether or not to treat <!--#include file=\"...\" --> comments as nested tomatos")
+	includePattern := flag.String("includePattern", "", "regular expression for include comments, its first group being the included path (implies -includes)")
+	attrEnums := flag.String("attrEnums", "", "comma separated attr=Enum pairs of string enums to set those attributes' values from")
+	enumsImport := flag.String("enumsImport", "", "where to import the -attrEnums enums from (defaults to -importLocation)")
+	eslintDisable := flag.String("eslintDisable", "", "comma separated ESLint rules to disable in the generated files (* disables all)")
+	prettierIgnore := flag.Bool("prettierIgnore", false, "whether or not to mark each generated class // prettier-ignore")
+	stats := flag.Bool("stats", false, "whether or not to print statistics about the generated views (of the first target)")
+	maxIncludeDepth := flag.Int("maxIncludeDepth", 0, "how deep nested tomatos may be built into each other (0 uses the default)")
+	sortAttrs := flag.Bool("sortAttrs", false, "whether or not to set attributes in sorted order rather than source order")
+	fragmentRootTag := flag.String("fragmentRootTag", "", "element to wrap templates with several root elements in (empty makes them an error)")
+	asyncBuild := flag.Bool("asyncBuild", false, "whether or not to build views' contents in an async method rather than their constructors")
+	asyncBuildMethod := flag.String("asyncBuildMethod", "", "name of the -asyncBuild method (defaults to buildAsync)")
+	validateCss := flag.Bool("validateCss", false, "whether or not to check <style> blocks for unbalanced braces and unterminated strings")
+	scopeAttribute := flag.Bool("scopeAttribute", false, "whether or not to scope all of each view's Css to the view's root, given the view's scope id, and what's under it")
+	devRefGuards := flag.Bool("devRefGuards", false, "whether or not refs that can be unset warn when they're read while unset")
+	devGuard := flag.String("devGuard", "", "condition the -devRefGuards warnings are behind (defaults to process.env.NODE_ENV !== 'production')")
+	includeTag := flag.String("includeTag", "", "tag of the elements nesting other templates (defaults to tomato)")
+	cssTypes := flag.Bool("cssTypes", false, "whether or not to write the views' class names as CSS module typings next to the stylesheet")
+	classTemplate := flag.String("classTemplate", "", "file holding a text/template to write the generated classes out through")
+	rootTextSetter := flag.String("rootTextSetter", "", "base class method to hand the text of roots holding only text to (empty appends it)")
+	problemsFile := flag.String("problems", "", "JSON file to write the warnings and errors to, as a list of {file, line, column, severity, message}")
+	registerFunction := flag.String("register", "", "function each view registers itself with on import, e.g. registerView (empty disables)")
+	registerImport := flag.String("registerImport", "", "where to import the -register function from (defaults to -importLocation)")
+	skipEmptyAttrs := flag.Bool("skipEmptyAttrs", false, "whether or not to leave out non-boolean attributes with empty values")
+	trackChildren := flag.Bool("trackChildren", false, "whether or not to register nested views with a ref with the view building them")
+	addChildMethod := flag.String("addChildMethod", "", "base class method -trackChildren registers nested views with (defaults to addChild)")
+	sanitizeViewNames := flag.Bool("sanitizeViewNames", false, "whether or not to make view names that aren't valid class names into ones rather than failing")
+	constructorGuard := flag.Bool("constructorGuard", false, "whether or not to clean up views whose construction throws (needs -statements)")
+	cleanupMethod := flag.String("cleanupMethod", "", "base class method -constructorGuard cleans up with (defaults to dispose)")
+	hyperscriptFunction := flag.String("hyperscriptFunction", "", "function the h language builds elements with (defaults to h)")
+	deprecateStripMe := flag.Bool("deprecateStripMe", false, "whether or not to warn about templates still wrapped in _stripme elements (errors with -strict)")
+	bareAttrsAsBooleans := flag.Bool("bareAttrsAsBooleans", false, "whether or not to set attributes written without a value as booleans, to '' whatever their type")
+	viewNameEnum := flag.Bool("viewNameEnum", false, "whether or not to emit an enum of the names of the generated views")
+	linkParents := flag.Bool("linkParents", false, "whether or not to hand nested views the view building them")
+	setParentMethod := flag.String("setParentMethod", "", "method -linkParents hands nested views their parent with (defaults to setParent)")
+	header := flag.Bool("header", false, "whether or not to start the generated files with a comment naming the tomato version")
+	headerTimestamp := flag.Bool("headerTimestamp", false, "whether or not the -header includes the time the files were generated at")
+	injectCss := flag.String("injectCss", "file", "where views' Css goes: file, style (injected once per view) or adopted (a constructable stylesheet per view)")
+	datasetMethod := flag.String("datasetMethod", "", "view method to set data-* attributes through by their dataset key, e.g. setData (empty sets them as attributes)")
+	appendGuards := flag.Bool("appendGuards", false, "whether or not to check elements have no parent before appending them, in development builds (needs -statements)")
+	appendGuardFunction := flag.String("appendGuardFunction", "", "function -appendGuards checks elements with (defaults to assertDetached)")
+	elementRefs := flag.String("elementRefs", "view", "what element refs hold: view, both (the view and the element, under a suffixed ref) or element (needs -statements)")
+	elementRefSuffix := flag.String("elementRefSuffix", "", "suffix of the refs holding elements (defaults to El)")
+	groupByDepth := flag.Int("groupByDepth", 0, "write a file per group of views sharing their first N folders (0 writes a single file)")
+	refsInterface := flag.Bool("refsInterface", false, "whether or not to emit an interface describing each view's refs")
+	refMap := flag.Bool("refMap", false, "whether or not to expose element refs as a single refs map instead of fields")
+	var targets targetList
+	flag.Var(&targets, "target", "lang:outfile to generate, may be repeated (overrides -language and -tomatoOut)")
 
 	flag.Parse()
 
-	if err := tomato.GenerateTomatoes(*tomatoIn, *tomatoOut, getLanguage(*language), &tomato.GeneratorOptions{
+	refStyle := tomato.RefFields
+	if *refMap {
+		refStyle = tomato.RefMap
+	}
+
+	var order tomato.SortOrder
+	switch *sortOrder {
+	case "path":
+		order = tomato.SortByPath
+	case "directory":
+		order = tomato.SortByDirectory
+	case "name":
+		order = tomato.SortByViewName
+	default:
+		fmt.Fprintln(os.Stderr, "unknown sort order: "+*sortOrder)
+		os.Exit(1)
+	}
+
+	var injection tomato.CssInjection
+	switch *injectCss {
+	case "file":
+		injection = tomato.CssFile
+	case "style":
+		injection = tomato.CssInjectStyle
+	case "adopted":
+		injection = tomato.CssInjectAdopted
+	default:
+		fmt.Fprintln(os.Stderr, "unknown css injection: "+*injectCss)
+		os.Exit(1)
+	}
+
+	var elementRefStyle tomato.ElementRefs
+	switch *elementRefs {
+	case "view":
+		elementRefStyle = tomato.ViewRefs
+	case "both":
+		elementRefStyle = tomato.ViewAndElementRefs
+	case "element":
+		elementRefStyle = tomato.ElementOnlyRefs
+	default:
+		fmt.Fprintln(os.Stderr, "unknown element refs: "+*elementRefs)
+		os.Exit(1)
+	}
+
+	logLevel := tomato.LogNormal
+	if *quiet {
+		logLevel = tomato.LogQuiet
+	} else if *verbose {
+		logLevel = tomato.LogVerbose
+	}
+
+	opts := &tomato.GeneratorOptions{
 		ViewBaseClass:  *viewBaseClass,
 		ViewFactory:    *viewFactory,
 		ImportLocation: *importLocation,
-	}, *forceDebugIds); err != nil {
-		fmt.Println(err.Error())
+
+		NormalizeNewlines:    *normalizeNewlines,
+		TrailingNewline:      *trailingNewline,
+		Hydrate:              *hydrate,
+		RefStyle:             refStyle,
+		ClassModule:          *classModule,
+		Logger:               &tomato.Logger{Out: os.Stderr, Level: logLevel},
+		StatementStyle:       *statements,
+		BulkAttrs:            *bulkAttrs,
+		SpecialPrefix:        *specialPrefix,
+		FragmentThreshold:    *fragmentThreshold,
+		ScaffoldDir:          *scaffoldDir,
+		InlineThreshold:      *inlineThreshold,
+		LintAria:             *lintAria,
+		Strict:               *strict,
+		MockTodos:            *mockTodos,
+		GroupByDepth:         *groupByDepth,
+		EmitRefsInterface:    *refsInterface,
+		SplitConstruction:    *splitConstruction,
+		DebugIdAttr:          *debugIdAttr,
+		TextRootTag:          *textRootTag,
+		AssetBaseURL:         *assetBaseURL,
+		AssetRoot:            *assetRoot,
+		EmitRegistry:         *registry,
+		SplitStyles:          *splitStyles,
+		DocumentParsing:      *documentParsing,
+		TagRoot:              *tagRoot,
+		ConstructorPrologue:  *prologue,
+		ConstructorEpilogue:  *epilogue,
+		SortOrder:            order,
+		EmitDebugRefs:        *debugRefs,
+		ReexportBase:         *reexportBase,
+		MaxWrapperDepth:      *maxWrapperDepth,
+		HotModuleReplacement: *hmr,
+		HotAccept:            *hotAccept,
+		CloneStrategy:        *cloneStrategy,
+		LineComments:         *lineComments,
+		EmitClassNames:       *classNames,
+		StrictMarkup:         *strictMarkup,
+		EnumsImportLocation:  *enumsImport,
+		PrettierIgnore:       *prettierIgnore,
+		MaxIncludeDepth:      *maxIncludeDepth,
+		SortAttrs:            *sortAttrs,
+		FragmentRootTag:      *fragmentRootTag,
+		AsyncBuild:           *asyncBuild,
+		AsyncBuildMethod:     *asyncBuildMethod,
+		ValidateCss:          *validateCss,
+		DevRefGuards:         *devRefGuards,
+		DevGuard:             *devGuard,
+		IncludeTag:           *includeTag,
+		SkipEmptyAttrs:       *skipEmptyAttrs,
+		EmitCssTypes:         *cssTypes,
+		RootTextSetter:       *rootTextSetter,
+		TrackChildren:        *trackChildren,
+		AddChildMethod:       *addChildMethod,
+		SanitizeViewNames:    *sanitizeViewNames,
+		ConstructorGuard:     *constructorGuard,
+		CleanupMethod:        *cleanupMethod,
+		DeprecateStripMe:     *deprecateStripMe,
+		BareAttrsAsBooleans:  *bareAttrsAsBooleans,
+		EmitViewNameEnum:     *viewNameEnum,
+		LinkParents:          *linkParents,
+		SetParentMethod:      *setParentMethod,
+		Header:               *header,
+		HeaderTimestamp:      *headerTimestamp,
+		InjectCss:            injection,
+		DatasetMethod:        *datasetMethod,
+		AppendGuards:         *appendGuards,
+		AppendGuardFunction:  *appendGuardFunction,
+		ElementRefs:          elementRefStyle,
+		ElementRefSuffix:     *elementRefSuffix,
+	}
+	if *hyperscriptFunction != "" {
+		opts.HyperscriptFunction = *hyperscriptFunction
+	}
+	if *includePattern != "" {
+		opts.IncludePattern = *includePattern
+	} else if *includes {
+		opts.IncludePattern = tomato.DefaultIncludePattern
+	}
+	if *classTemplate != "" {
+		contents, err := ioutil.ReadFile(*classTemplate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		opts.ClassTemplate = string(contents)
+	}
+	if *registerFunction != "" {
+		opts.RegisterFunction = *registerFunction
+		opts.RegisterImportLocation = *registerImport
+	}
+	if *scopeAttribute {
+		opts.ScopeStrategy = tomato.ScopeAttribute
+	}
+	if *optionsConstructor {
+		opts.ConstructorStyle = tomato.ConstructorOptions
+	}
+	if *allowedAttrs != "" {
+		opts.AllowedAttrs = strings.Split(*allowedAttrs, ",")
+	}
+	if *deniedAttrs != "" {
+		opts.DeniedAttrs = strings.Split(*deniedAttrs, ",")
+	}
+	if *eslintDisable != "" {
+		opts.EslintDisable = strings.Split(*eslintDisable, ",")
+	}
+	if *attrEnums != "" {
+		opts.AttrEnums = map[string]string{}
+		for _, pair := range strings.Split(*attrEnums, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				fmt.Fprintln(os.Stderr, "attribute enums must be of the form attr=Enum: "+pair)
+				os.Exit(1)
+			}
+			opts.AttrEnums[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+	if *tagFactories != "" {
+		opts.TagFactories = map[string]string{}
+		for _, pair := range strings.Split(*tagFactories, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				fmt.Fprintln(os.Stderr, "tag factories must be of the form tag=factory: "+pair)
+				os.Exit(1)
+			}
+			opts.TagFactories[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+	if *attrTypes {
+		opts.AttrTypes = tomato.DefaultAttrTypes
+	}
+
+	// Views are keyed by their templates, so only the first target's views are counted.
+	views := make(map[string]*tomato.View)
+	if *stats {
+		opts.OnViewGenerated = func(name, path string, v *tomato.View) {
+			if _, ok := views[path]; !ok {
+				views[path] = v
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		targets = targetList{*language + ":" + *tomatoOut}
+	}
+
+	var generatorTargets []tomato.Target
+	for _, target := range targets {
+		parts := strings.SplitN(target, ":", 2)
+		language, ok := getLanguage(parts[0])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown target language %q\n", parts[0])
+			os.Exit(1)
+		}
+		generatorTargets = append(generatorTargets, tomato.Target{
+			Language: language,
+			OutFile:  parts[1],
+			Options:  opts,
+		})
+	}
+
+	if *problemsFile != "" {
+		opts.Logger.KeepDiagnostics = true
+	}
+	err := tomato.GenerateTomatoTargets(*tomatoIn, generatorTargets, *forceDebugIds)
+	if *problemsFile != "" {
+		if err := writeProblems(*problemsFile, opts.Logger, err); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if *stats {
+		fmt.Println(tomato.CollectStats(views))
 	}
 }
 
-func getLanguage(language string) tomato.Language {
-	// TODO(jaime): support other languages
-	if "ts" != language {
-		log.Panic(errors.New("That language is currently not supported!"))
+// Writes the kept warnings, along with the error that stopped generation if any, as a JSON list.
+func writeProblems(problemsFile string, logger *tomato.Logger, genErr error) error {
+	problems := append([]tomato.Diagnostic{}, logger.Diagnostics...)
+	if genErr != nil {
+		var d *tomato.Diagnostic
+		if errors.As(genErr, &d) {
+			problems = append(problems, *d)
+		} else {
+			problems = append(problems, tomato.Diagnostic{Severity: tomato.SeverityError, Message: genErr.Error()})
+		}
+	}
+	data := &bytes.Buffer{}
+	encoder := json.NewEncoder(data)
+	encoder.SetEscapeHTML(false) // Messages quote tags.
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(problems); err != nil {
+		return err
 	}
+	return ioutil.WriteFile(problemsFile, data.Bytes(), 0644)
+}
 
-	return tomato.TypeScript
+func getLanguage(language string) (tomato.Language, bool) {
+	// TODO(jaime): support other languages
+	switch language {
+	case "ts":
+		return tomato.TypeScript, true
+	case "html":
+		return tomato.HTML, true
+	case "h":
+		return tomato.Hyperscript, true
+	}
+	return tomato.TypeScript, false
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/donjaime/tomato"
+)
+
+func TestWriteProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tomato")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	template := filepath.Join(dir, "card.htmto")
+	if err := ioutil.WriteFile(template, []byte("<div>\n  <tomato src=\"item.htmto\"><b _ref=\"x\"></b></tomato>\n</div>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "item.htmto"), []byte("<li>item</li>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same problem, first as a kept warning and then as the error stopping a Strict generation.
+	logger := &tomato.Logger{Out: ioutil.Discard, KeepDiagnostics: true}
+	opts := &tomato.GeneratorOptions{ViewBaseClass: "View", ViewFactory: "createView", ImportLocation: "../ts/view", Logger: logger}
+	outFile := filepath.Join(dir, "gen", "views.ts")
+	if err := tomato.GenerateTomatoes(template, outFile, tomato.TypeScript, opts, false); err != nil {
+		t.Fatal(err)
+	}
+	opts.Strict = true
+	genErr := tomato.GenerateTomatoes(template, outFile, tomato.TypeScript, opts, false)
+	if genErr == nil {
+		t.Fatal("Strict generation didn't fail")
+	}
+
+	problemsFile := filepath.Join(dir, "problems.json")
+	if err := writeProblems(problemsFile, logger, genErr); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(problemsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problems []map[string]interface{}
+	if err := json.Unmarshal(data, &problems); err != nil {
+		t.Fatal(err)
+	}
+
+	message := "div > tomato > b: ref x is never set, the element isn't built"
+	want := []map[string]interface{}{
+		{"file": template, "line": 2.0, "severity": "warning", "message": message},
+		{"file": template, "line": 2.0, "severity": "error", "message": message},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %s, want %v", data, want)
+	}
+
+	// Columns, when known, are named like the rest.
+	full, err := json.Marshal(tomato.Diagnostic{File: "a.htmto", Line: 3, Column: 7, Severity: tomato.SeverityError, Message: "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"file":"a.htmto","line":3,"column":7,"severity":"error","message":"m"}`; string(full) != want {
+		t.Errorf("diagnostic = %s, want %s", full, want)
+	}
+}
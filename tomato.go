@@ -3,44 +3,216 @@ package tomato
 import (
 	"bytes"
 	"container/list"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
+
+	"golang.org/x/net/html"
 )
 
 const (
 	tomatoFileExtension = ".htmto"
+
+	// Optional file of GeneratorOptions overrides (as JSON, keyed by field name) for the templates in
+	// its folder and the folders below it.
+	tomatoOptionsFile = ".tomato.json"
 )
 
+// The version of tomato named in the Header of generated files. Set when building tomato, with
+// -ldflags "-X github.com/donjaime/tomato.Version=v1.2.3".
+var Version = "dev"
+
+// The line of a Header holding the time a file was generated, whatever the comment syntax around it.
+// Only the one right after the Header's first line counts, not lines like it in the views themselves.
+var headerTimestampLine = regexp.MustCompile(`\A(.*Generated by tomato .*\n).*Generated at \d{4}-\d{2}-\d{2}T[0-9:]+Z.*\n`)
+
+// A single output of a generation run.
+type Target struct {
+	Language Language
+	OutFile  string
+	Options  *GeneratorOptions
+}
+
 func GenerateTomatoes(viewDir string, outFile string, language Language, opts *GeneratorOptions, forceDebugIds bool) error {
-	files, err := collectTomatoFiles(viewDir)
+	return GenerateTomatoTargets(viewDir, []Target{{language, outFile, opts}}, forceDebugIds)
+}
+
+// Generates several outputs from the same templates. Each template is only parsed once and shared by all
+// of the targets, which keeps the outputs in lockstep. viewDir may also be a single template, generating
+// its view along with those of the nested tomatos it references, however deeply.
+func GenerateTomatoTargets(viewDir string, targets []Target, forceDebugIds bool) error {
+	files, err := CollectTomatoFiles(viewDir)
 	if err != nil {
 		return err
 	}
+	// A single template is generated as though its directory held just it and its nested tomatos.
+	single := false
+	if info, err := os.Stat(viewDir); err == nil && !info.IsDir() {
+		viewDir, single = filepath.Dir(viewDir), true
+	}
 
-	generator, err := MakeTomatoGenerator(language, opts)
-	if err != nil {
-		return err
+	// Templates are parsed once per special attribute prefix, since that changes how they parse.
+	templatesByPrefix := make(map[string]*list.List)
+	for _, target := range targets {
+		generator, err := MakeTomatoGenerator(target.Language, target.Options)
+		if err != nil {
+			return err
+		}
+
+		templates, ok := templatesByPrefix[target.Options.SpecialPrefix]
+		if !ok {
+			targetFiles := files
+			if single {
+				if targetFiles, err = withNestedTemplates(files, target.Options); err != nil {
+					return err
+				}
+			}
+			if templates, err = loadTemplates(targetFiles, target.Options); err != nil {
+				return err
+			}
+			for e := templates.Front(); e != nil; e = e.Next() {
+				t := e.Value.(*template)
+				if t.overrides, err = findOptionOverrides(viewDir, t.fileName); err != nil {
+					return err
+				}
+			}
+			templatesByPrefix[target.Options.SpecialPrefix] = templates
+		}
+
+		// Now that we have the parsed tomatoes. Go ahead and generate the view strings.
+		views, err := generator.generateViews(templates, forceDebugIds)
+		if err != nil {
+			return err
+		}
+
+		// Write the file to disk.
+		if err := writeTomatoOutput(viewDir, target.OutFile, views, generator, target.Options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Generates TypeScript views from templates that are already in memory, keyed by file name, the same
+// as GenerateViews would from the files. Nothing is read from disk, so the templates' nested tomatos and
+// layouts have to be among the sources too. The file names name the views and resolve those references.
+func GenerateViewsFromSources(sources map[string]string, opts *GeneratorOptions, forceDebugIds bool) (map[string]*View, error) {
+	fileNames := make([]string, 0, len(sources))
+	for fileName := range sources {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	sourceOpts := *opts
+	sourceOpts.sources = make(map[string]string, len(sources))
+	files := list.New()
+	for _, fileName := range fileNames {
+		sourceOpts.sources[filepath.Clean(fileName)] = sources[fileName]
+		files.PushBack(fileName)
 	}
 
-	// Now that we have the tomato file paths. Go ahead and generate the view strings.
-	views, err := generator.GenerateViews(files, forceDebugIds)
+	generator, err := MakeTomatoGenerator(TypeScript, &sourceOpts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return generator.GenerateViews(files, forceDebugIds)
+}
+
+// Returns the templates the given template depends on: the nested tomatos it references and the layout
+// it extends (along with the layout's own dependencies). Paths are resolved relative to the referencing
+// template and listed in document order without duplicates. opts may be nil to use the defaults.
+func Dependencies(fileName string, opts *GeneratorOptions) ([]string, error) {
+	if opts == nil {
+		opts = &GeneratorOptions{}
+	}
+	deps := []string{}
+	if err := collectDependencies(fileName, opts, &deps, []string{fileName}); err != nil {
+		return nil, err
 	}
+	return deps, nil
+}
 
-	// Write the file to disk.
-	if err := writeTomatoOutput(outFile, views, generator); err != nil {
+func collectDependencies(fileName string, opts *GeneratorOptions, deps *[]string, chain []string) error {
+	rootElem, _, err := parseTemplate(fileName, opts, nil, nil)
+	if err != nil || rootElem == nil {
 		return err
 	}
 
-	return nil
+	add := func(dep string) {
+		if !contains(*deps, dep) {
+			*deps = append(*deps, dep)
+		}
+	}
+
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		if n.Type == html.ElementNode && strings.ToLower(n.Data) == opts.includeTag() && hasAttr(n, "src") {
+			add(resolveSrc(fileName, getAttr(n, "src")))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(rootElem)
+
+	extendsAttr := opts.specialAttr(ExtendsAttr)
+	if !hasAttr(rootElem, extendsAttr) {
+		return nil
+	}
+	layoutFile := resolveSrc(fileName, getAttr(rootElem, extendsAttr))
+	if contains(chain, layoutFile) {
+		return fmt.Errorf("Layout cycle: %s", strings.Join(append(chain, layoutFile), " -> "))
+	}
+	add(layoutFile)
+	return collectDependencies(layoutFile, opts, deps, append(chain, layoutFile))
 }
 
-func collectTomatoFiles(root string) (*list.List, error) {
+// Adds the templates that those in files reference through nested tomatos, however deeply, so that the
+// views they build are generated along with them. Missing ones are left for generation to report.
+func withNestedTemplates(files *list.List, opts *GeneratorOptions) (*list.List, error) {
+	var fileNames []string
+	for e := files.Front(); e != nil; e = e.Next() {
+		fileNames = append(fileNames, filepath.Clean(e.Value.(string)))
+	}
+
+	all := list.New()
+	for i := 0; i < len(fileNames); i++ {
+		all.PushBack(fileNames[i])
+		t, err := loadTemplate(fileNames[i], opts)
+		if err != nil {
+			return nil, err
+		} else if t.root == nil {
+			continue
+		}
+		for _, src := range nestedTomatoSrcs(t.root, opts, true) {
+			nested := filepath.Clean(resolveSrc(fileNames[i], src))
+			if filepath.Ext(nested) == tomatoFileExtension && templateExists(nested, opts) && !contains(fileNames, nested) {
+				fileNames = append(fileNames, nested)
+			}
+		}
+	}
+	return all, nil
+}
+
+// Lists the templates under root, or just root when it's a template itself, the way GenerateTomatoes
+// finds them.
+func CollectTomatoFiles(root string) (*list.List, error) {
 	l := list.New()
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		if !strings.HasSuffix(info.Name(), tomatoFileExtension) {
+			return nil, fmt.Errorf("%s isn't a %s template", root, tomatoFileExtension)
+		}
+		l.PushBack(root)
+		return l, nil
+	}
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -57,12 +229,35 @@ func collectTomatoFiles(root string) (*list.List, error) {
 	}
 }
 
+// The options files applying to a template within viewDir, outermost first.
+func findOptionOverrides(viewDir, fileName string) ([]string, error) {
+	rel, err := filepath.Rel(viewDir, filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var overrides []string
+	dir := viewDir
+	for _, name := range append([]string{"."}, strings.Split(filepath.ToSlash(rel), "/")...) {
+		dir = filepath.Join(dir, name)
+		optionsFile := filepath.Join(dir, tomatoOptionsFile)
+		if _, err := os.Stat(optionsFile); err == nil {
+			overrides = append(overrides, optionsFile)
+		}
+	}
+	return overrides, nil
+}
+
 func existingFileContentMatches(filename string, expectedData []byte) bool {
 	actualData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return false // If we couldn't read the file, it doesn't match.
 	}
 
+	// A new timestamp alone doesn't make the file any different.
+	expectedData = headerTimestampLine.ReplaceAll(expectedData, []byte("$1"))
+	actualData = headerTimestampLine.ReplaceAll(actualData, []byte("$1"))
+
 	if len(expectedData) != len(actualData) {
 		return false // If the number of bytes differs, we know it doesn't match.
 	}
@@ -82,14 +277,117 @@ func writeFileIfChanged(filename string, data []byte, perm os.FileMode) error {
 	return ioutil.WriteFile(filename, data, perm)
 }
 
+// The Header of a generated file, as comment lines.
+func fileHeader(commentLine func(text string) string, opts *GeneratorOptions) string {
+	header := commentLine("Generated by tomato "+Version+". DO NOT EDIT.") + "\n"
+	if opts.HeaderTimestamp {
+		header += commentLine("Generated at "+time.Now().UTC().Format(time.RFC3339)) + "\n"
+	}
+	return header
+}
+
+// Write the generated views to disk, either all to outFile or, when grouping by directory, to a file per
+// group next to it.
+func writeTomatoOutput(viewDir, outFile string, views map[string]*View, generator TomatoGenerator, opts *GeneratorOptions) error {
+	if opts.GroupByDepth <= 0 {
+		return writeTomatoFile(outFile, views, generator, opts, nil, viewNamesOf(views, opts))
+	}
+
+	groups := make(map[string]map[string]*View)
+	viewGroups := make(map[string]string) // View name to the group it is written to.
+	for file, view := range views {
+		group, err := viewGroup(viewDir, file, opts.GroupByDepth)
+		if err != nil {
+			return err
+		}
+		if groups[group] == nil {
+			groups[group] = make(map[string]*View)
+		}
+		groups[group][file] = view
+		viewGroups[opts.viewName(file)] = group
+	}
+
+	// The view name enum lists every view once, in outFile, which is written even without views of its own.
+	if opts.EmitViewNameEnum && groups[""] == nil {
+		groups[""] = make(map[string]*View)
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for group := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+
+	for _, group := range groupNames {
+		// Nested views living in other groups need to be imported from those groups' files.
+		imports := make(map[string][]string)
+		for _, view := range groups[group] {
+			for _, nested := range view.nestedViews {
+				other, ok := viewGroups[nested]
+				from := "./" + strings.TrimSuffix(filepath.Base(groupOutFile(outFile, other)), filepath.Ext(outFile))
+				if ok && other != group && !contains(imports[from], nested) {
+					imports[from] = append(imports[from], nested)
+				}
+			}
+		}
+
+		var enumNames []string
+		if group == "" {
+			enumNames = viewNamesOf(views, opts)
+		}
+		if err := writeTomatoFile(groupOutFile(outFile, group), groups[group], generator, opts, imports, enumNames); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Groups are named after the first depth directories (joined with dashes) of a template's path within
+// viewDir. Templates above that depth group by however many directories they do have, and those right
+// in viewDir land in the unnamed group.
+func viewGroup(viewDir, file string, depth int) (string, error) {
+	rel, err := filepath.Rel(viewDir, filepath.Dir(file))
+	if err != nil || rel == "." {
+		return "", err
+	}
+
+	dirs := strings.Split(filepath.ToSlash(rel), "/")
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	return strings.Join(dirs, "-"), nil
+}
+
+// The unnamed group goes to outFile itself, the others to files named after them next to it.
+func groupOutFile(outFile, group string) string {
+	if group == "" {
+		return outFile
+	}
+	return filepath.Join(filepath.Dir(outFile), group+filepath.Ext(outFile))
+}
+
+// The names of the views, in the order they're written in.
+func viewNamesOf(views map[string]*View, opts *GeneratorOptions) []string {
+	keys := make([]string, 0, len(views))
+	for k := range views {
+		keys = append(keys, k)
+	}
+	sortViewFiles(keys, opts)
+
+	viewNames := make([]string, len(keys))
+	for i, key := range keys {
+		viewNames[i] = opts.viewName(key)
+	}
+	return viewNames
+}
+
 // Write the generated views to a file. This file should never ever be more than
-// on the order of a few thousand lines, so it lives all in memory.
-func writeTomatoOutput(outFile string, views map[string]*View, generator TomatoGenerator) error {
+// on the order of a few thousand lines, so it lives all in memory. The view name enum goes in the
+// file when enumNames isn't nil, listing them.
+func writeTomatoFile(outFile string, views map[string]*View, generator TomatoGenerator, opts *GeneratorOptions, imports map[string][]string, enumNames []string) error {
 	viewText := &bytes.Buffer{}
 	cssText := &bytes.Buffer{}
 
-	generator.EmitPreamble(viewText)
-
 	// Ensure a stable sort order based on filename
 	keys := make([]string, len(views))
 	i := 0
@@ -97,18 +395,72 @@ func writeTomatoOutput(outFile string, views map[string]*View, generator TomatoG
 		keys[i] = k
 		i++
 	}
-	sort.Strings(keys)
+	sortViewFiles(keys, opts)
 
+	// Views generated with overridden options may need their own view library.
+	viewOpts := make([]*GeneratorOptions, 0, len(keys))
 	for _, key := range keys {
+		if views[key].opts != nil {
+			viewOpts = append(viewOpts, views[key].opts)
+		} else {
+			viewOpts = append(viewOpts, opts)
+		}
+	}
+	runtimeImports := runtimeImportsOf(viewOpts, opts)
+	if err := checkRuntimeImports(runtimeImports); err != nil {
+		return fmt.Errorf("%s: %s", outFile, err.Error())
+	}
+	if opts.Header {
+		viewText.WriteString(fileHeader(generator.commentLine, opts))
+	}
+	generator.emitPreamble(viewText, runtimeImports)
+
+	if _, ok := generator.(*typeScriptGenerator); ok && opts.ScaffoldDir != "" {
+		if err := emitSubclassImports(viewText, outFile, keys, views, opts); err != nil {
+			return err
+		}
+	}
+
+	froms := make([]string, 0, len(imports))
+	for from := range imports {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		names := imports[from]
+		sort.Strings(names)
+		generator.emitImport(viewText, names, from)
+	}
+
+	// Separators only go between entries, so the last one doesn't leave a trailing separator behind.
+	for i, key := range keys {
 		content := views[key]
+		if i > 0 {
+			viewText.WriteString(opts.viewSeparator())
+		}
 		viewText.WriteString(content.ViewText)
-		viewText.WriteString("\n\n")
 
 		if content.CssText != "" {
+			if cssText.Len() > 0 {
+				cssText.WriteString(opts.cssSeparator())
+			}
 			cssText.WriteString(content.CssText)
-			cssText.WriteString("\n\n")
 		}
 	}
+
+	viewNames := make([]string, len(keys))
+	for i, key := range keys {
+		viewNames[i] = opts.viewName(key)
+	}
+	if opts.EmitRegistry {
+		generator.emitRegistry(viewText, viewNames)
+	}
+	if opts.EmitViewNameEnum && enumNames != nil {
+		generator.emitViewNameEnum(viewText, enumNames)
+	}
+	if opts.HotModuleReplacement {
+		generator.emitHotModuleReplacement(viewText, filepath.ToSlash(filepath.Clean(outFile)))
+	}
 	generator.EmitPostamble(viewText)
 
 	// Dump the file to disk.
@@ -116,12 +468,251 @@ func writeTomatoOutput(outFile string, views map[string]*View, generator TomatoG
 		return err
 	}
 
-	// Dump an associated Css file.
-	css := cssText.String()
+	// Dump an associated Css file, when there is any Css. Empty ones left behind by earlier runs are
+	// cleaned up.
+	css := normalizeOutput(cssText.Bytes(), opts)
 	cssOutFile := string(outFile[:strings.LastIndex(outFile, ".")]) + ".scss"
-	if err := writeFileIfChanged(cssOutFile, []byte(css), 0644); err != nil {
+	if len(bytes.TrimSpace(css)) > 0 {
+		if opts.Header {
+			css = append([]byte(fileHeader(func(text string) string { return "// " + text }, opts)), css...)
+		}
+		if err := writeFileIfChanged(cssOutFile, css, 0644); err != nil {
+			return err
+		}
+	} else if existing, err := ioutil.ReadFile(cssOutFile); err == nil && len(bytes.TrimSpace(existing)) == 0 {
+		if err := os.Remove(cssOutFile); err != nil {
+			return err
+		}
+	}
+
+	if opts.EmitCssTypes {
+		if err := writeCssTypes(cssOutFile+".d.ts", outFile, keys, views, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.ScaffoldDir != "" {
+		if err := scaffoldSubclasses(outFile, keys, views, opts); err != nil {
+			return err
+		}
+	}
+
+	opts.Logger.Infof("writing %d views to %s", len(views), outFile)
+	return writeFileIfChanged(outFile, normalizeOutput(viewText.Bytes(), opts), 0644)
+}
+
+// Writes the class names of the views as the typings of a CSS module, when they have any.
+func writeCssTypes(typesFile, outFile string, keys []string, views map[string]*View, opts *GeneratorOptions) error {
+	var classNames []string
+	for _, key := range keys {
+		for _, class := range views[key].classNames {
+			if !contains(classNames, class) {
+				classNames = append(classNames, class)
+			}
+		}
+	}
+	if len(classNames) == 0 {
+		return nil
+	}
+	sort.Strings(classNames)
+
+	types := &bytes.Buffer{}
+	types.WriteString("// Class names used by the views in " + filepath.Base(outFile) + ".\n")
+	types.WriteString("declare const styles: {\n")
+	for _, class := range classNames {
+		types.WriteString("  readonly '" + escapeText(class) + "': string;\n")
+	}
+	types.WriteString("};\nexport default styles;\n")
+	return writeFileIfChanged(typesFile, normalizeOutput(types.Bytes(), opts), 0644)
+}
+
+// What a file imports from a view library.
+type runtimeImport struct {
+	from  string
+	names []string
+	bases []string // The base classes and factories among the names.
+}
+
+// The imports from the view libraries of the given views' options, in the order they're first needed,
+// followed by those of their enums and register function. With no views, the file still imports what
+// the defaults need.
+func runtimeImportsOf(viewOpts []*GeneratorOptions, defaults *GeneratorOptions) []runtimeImport {
+	if len(viewOpts) == 0 {
+		viewOpts = []*GeneratorOptions{defaults}
+	}
+
+	var imports []runtimeImport
+	add := func(from string, names []string, bases int) {
+		i := 0
+		for i < len(imports) && imports[i].from != from {
+			i++
+		}
+		if i == len(imports) {
+			imports = append(imports, runtimeImport{from: from})
+		}
+		for n, name := range names {
+			if !contains(imports[i].names, name) {
+				imports[i].names = append(imports[i].names, name)
+				if n < bases {
+					imports[i].bases = append(imports[i].bases, name)
+				}
+			}
+		}
+	}
+	for _, opts := range viewOpts {
+		add(opts.ImportLocation, opts.runtimeNames(), 2)
+	}
+	for _, opts := range viewOpts {
+		if enums := opts.enumNames(); len(enums) > 0 {
+			add(opts.enumsImportLocation(), enums, 0)
+		}
+		if opts.RegisterFunction != "" && opts.ScaffoldDir == "" { // Otherwise the stubs register.
+			add(opts.registerImportLocation(), []string{opts.RegisterFunction}, 0)
+		}
+	}
+	return imports
+}
+
+// Every name can only be imported from one place.
+func checkRuntimeImports(imports []runtimeImport) error {
+	from := make(map[string]string)
+	for _, runtime := range imports {
+		for _, name := range runtime.names {
+			if other, ok := from[name]; ok {
+				return fmt.Errorf("%s is imported from both '%s' and '%s', rename one of them or generate their views into separate files", name, other, runtime.from)
+			}
+			from[name] = runtime.from
+		}
+	}
+	return nil
+}
+
+// Sorts template paths into the order their views are written out in.
+func sortViewFiles(files []string, opts *GeneratorOptions) {
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		switch opts.SortOrder {
+		case SortByDirectory:
+			// Directory by directory, so that a/x sorts next to a rather than after a-b.
+			dirsA := strings.Split(filepath.ToSlash(filepath.Dir(a)), "/")
+			dirsB := strings.Split(filepath.ToSlash(filepath.Dir(b)), "/")
+			for k := 0; k < len(dirsA) && k < len(dirsB); k++ {
+				if dirsA[k] != dirsB[k] {
+					return dirsA[k] < dirsB[k]
+				}
+			}
+			if len(dirsA) != len(dirsB) {
+				return len(dirsA) < len(dirsB)
+			}
+		case SortByViewName:
+			if nameA, nameB := opts.viewName(a), opts.viewName(b); nameA != nameB {
+				return nameA < nameB
+			}
+		}
+		return a < b
+	})
+}
+
+// Writes a developer owned subclass stub for each generated Base view. Existing stubs are never
+// touched, they belong to the developers once created.
+func scaffoldSubclasses(outFile string, files []string, views map[string]*View, opts *GeneratorOptions) error {
+	if err := os.MkdirAll(opts.ScaffoldDir, 0777); err != nil {
 		return err
 	}
 
-	return writeFileIfChanged(outFile, viewText.Bytes(), 0644)
+	importPath, err := relativeImport(opts.ScaffoldDir, strings.TrimSuffix(outFile, filepath.Ext(outFile)))
+	if err != nil {
+		return err
+	}
+	registerImport := opts.registerImportLocation()
+	if strings.HasPrefix(registerImport, ".") {
+		// Relative to the generated file, rather than to the stubs.
+		if registerImport, err = relativeImport(opts.ScaffoldDir, filepath.Join(filepath.Dir(outFile), registerImport)); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		viewName := opts.viewName(file)
+		stubFile := filepath.Join(opts.ScaffoldDir, viewName+filepath.Ext(outFile))
+		stub, err := os.OpenFile(stubFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		baseName := opts.className(viewName)
+		text := &bytes.Buffer{}
+		fmt.Fprintf(text, "import { %s } from '%s';\n", baseName, importPath)
+		if key := views[file].registerKey; key != "" {
+			fmt.Fprintf(text, "import { %s } from '%s';\n", opts.RegisterFunction, registerImport)
+		}
+		fmt.Fprintf(text, "\nexport class %s extends %s {\n}\n\n%s.subclass = %s;\n", viewName, baseName, baseName, viewName)
+		if key := views[file].registerKey; key != "" {
+			fmt.Fprintf(text, "%s('%s', %s);\n", opts.RegisterFunction, escapeText(key), viewName)
+		}
+		_, err = stub.Write(text.Bytes())
+		if closeErr := stub.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		opts.Logger.Infof("scaffolded %s", stubFile)
+	}
+	return nil
+}
+
+// Imports the types of the subclasses that nested views are built as. Only their types, since the
+// subclasses' modules import this one.
+func emitSubclassImports(buffer *bytes.Buffer, outFile string, files []string, views map[string]*View, opts *GeneratorOptions) error {
+	var nested []string
+	for _, file := range files {
+		for _, viewName := range views[file].nestedViews {
+			if !contains(nested, viewName) {
+				nested = append(nested, viewName)
+			}
+		}
+	}
+	sort.Strings(nested)
+
+	for _, viewName := range nested {
+		from, err := relativeImport(filepath.Dir(outFile), filepath.Join(opts.ScaffoldDir, viewName))
+		if err != nil {
+			return err
+		}
+		buffer.WriteString("\nimport type { " + viewName + " } from '" + from + "';")
+	}
+	return nil
+}
+
+// The module path importing target from a module in dir.
+func relativeImport(dir, target string) (string, error) {
+	path, err := filepath.Rel(dir, target)
+	if err != nil {
+		return "", err
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, ".") {
+		path = "./" + path
+	}
+	return path, nil
+}
+
+// Applies the line ending and trailing newline policies so that the generated bytes are identical
+// regardless of the platform (or the editor settings) the templates were authored on.
+func normalizeOutput(data []byte, opts *GeneratorOptions) []byte {
+	if opts.NormalizeNewlines {
+		data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+		data = bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+	}
+
+	if opts.TrailingNewline {
+		data = bytes.TrimRight(data, " \t\r\n")
+		if len(data) > 0 {
+			data = append(data, '\n')
+		}
+	}
+	return data
 }
@@ -0,0 +1,89 @@
+package tomato
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The WAI-ARIA 1.1 roles.
+var ariaRoles = []string{
+	"alert", "alertdialog", "application", "article", "banner", "button", "cell", "checkbox", "columnheader",
+	"combobox", "complementary", "contentinfo", "definition", "dialog", "directory", "document", "feed",
+	"figure", "form", "grid", "gridcell", "group", "heading", "img", "link", "list", "listbox", "listitem",
+	"log", "main", "marquee", "math", "menu", "menubar", "menuitem", "menuitemcheckbox", "menuitemradio",
+	"navigation", "none", "note", "option", "presentation", "progressbar", "radio", "radiogroup", "region",
+	"row", "rowgroup", "rowheader", "scrollbar", "search", "searchbox", "separator", "slider", "spinbutton",
+	"status", "switch", "tab", "table", "tablist", "tabpanel", "term", "textbox", "timer", "toolbar",
+	"tooltip", "tree", "treegrid", "treeitem",
+}
+
+// The WAI-ARIA 1.1 states and properties.
+var ariaAttrs = []string{
+	"aria-activedescendant", "aria-atomic", "aria-autocomplete", "aria-busy", "aria-checked", "aria-colcount",
+	"aria-colindex", "aria-colspan", "aria-controls", "aria-current", "aria-describedby", "aria-details",
+	"aria-disabled", "aria-dropeffect", "aria-errormessage", "aria-expanded", "aria-flowto", "aria-grabbed",
+	"aria-haspopup", "aria-hidden", "aria-invalid", "aria-keyshortcuts", "aria-label", "aria-labelledby",
+	"aria-level", "aria-live", "aria-modal", "aria-multiline", "aria-multiselectable", "aria-orientation",
+	"aria-owns", "aria-placeholder", "aria-posinset", "aria-pressed", "aria-readonly", "aria-relevant",
+	"aria-required", "aria-roledescription", "aria-rowcount", "aria-rowindex", "aria-rowspan",
+	"aria-selected", "aria-setsize", "aria-sort", "aria-valuemax", "aria-valuemin", "aria-valuenow",
+	"aria-valuetext",
+}
+
+func init() {
+	sort.Strings(ariaRoles)
+	sort.Strings(ariaAttrs)
+}
+
+// Checks an element's attributes against a small set of ARIA rules, returning a description of each
+// problem found.
+func lintAria(node *html.Node) []string {
+	var problems []string
+	for _, attr := range node.Attr {
+		if attr.Key == "role" {
+			for _, role := range strings.Fields(attr.Val) {
+				if !sortedContains(ariaRoles, role) {
+					problems = append(problems, "unknown role '"+role+"'")
+				}
+			}
+		} else if strings.HasPrefix(attr.Key, "aria-") && !sortedContains(ariaAttrs, attr.Key) {
+			problems = append(problems, "unknown ARIA attribute '"+attr.Key+"'")
+		}
+	}
+
+	// Buttons with nothing but an icon in them need a name from somewhere else.
+	isButton := strings.ToLower(node.Data) == "button" || getAttr(node, "role") == "button"
+	if isButton && !hasAccessibleName(node) {
+		problems = append(problems, "button has no text, aria-label, aria-labelledby or title")
+	}
+	return problems
+}
+
+func hasAccessibleName(node *html.Node) bool {
+	if hasAttr(node, "aria-label") || hasAttr(node, "aria-labelledby") || hasAttr(node, "title") {
+		return true
+	}
+
+	var hasName func(n *html.Node) bool
+	hasName = func(n *html.Node) bool {
+		if n.Type == html.TextNode && strings.TrimFunc(n.Data, isCollapsibleSpace) != "" {
+			return true
+		} else if n.Type == html.ElementNode && strings.ToLower(n.Data) == "img" && hasAttr(n, "alt") {
+			return true
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if hasName(c) {
+				return true
+			}
+		}
+		return false
+	}
+	return hasName(node)
+}
+
+func sortedContains(sorted []string, val string) bool {
+	i := sort.SearchStrings(sorted, val)
+	return i < len(sorted) && sorted[i] == val
+}
@@ -4,24 +4,91 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
 	"unicode"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 type Language int
 
+// The order views are written out in.
+type SortOrder int
+
+const (
+	SortByPath      SortOrder = iota // By the templates' full paths.
+	SortByDirectory                  // By the templates' directories, then their file names.
+	SortByViewName                   // By view name, then path for views sharing a name.
+)
+
+// How views take their props.
+type ConstructorStyle int
+
+const (
+	ConstructorPositional ConstructorStyle = iota // The document (and className) only, views can't have props.
+	ConstructorOptions                            // The props in an options object ahead of the document.
+)
+
+// How the Css of a view is kept from applying outside of it.
+type ScopeStrategy int
+
+const (
+	ScopeNesting   ScopeStrategy = iota // <style scoped> blocks nest under a selector for the root's view name, for SCSS to flatten.
+	ScopeAttribute                      // All of the view's selectors are limited to the root, given its scope id, and what's under it.
+)
+
+// Which refs the plain elements of a view are kept under.
+type ElementRefs int
+
+const (
+	ViewRefs           ElementRefs = iota // The view wrapping the element (this.header: View).
+	ViewAndElementRefs                    // The view, and the element itself under a second ref (this.headerEl: HTMLElement).
+	ElementOnlyRefs                       // The element itself, under its element ref only.
+)
+
+// Where the Css of a view goes.
+type CssInjection int
+
+const (
+	CssFile          CssInjection = iota // To the stylesheet written next to the views.
+	CssInjectStyle                       // Into a <style> in the document's head, by the first instance of the view.
+	CssInjectAdopted                     // Into a constructable stylesheet, created once per view and adopted by the document.
+)
+
+// Attribute holding a view's scope id under ScopeAttribute.
+const ScopeIdAttr = "data-s"
+
+// How element refs are exposed on the generated views.
+type RefStyle int
+
+const (
+	RefFields RefStyle = iota // A typed field per ref (this.header).
+	RefMap                    // A single refs map keyed by ref name (this.refs['header']).
+)
+
 const (
-	TypeScript Language = iota
+	TypeScript  Language = iota
+	HTML                 // The normalized templates, rather than views.
+	Hyperscript          // View functions returning h() calls, for JSX runtimes.
 )
 
-// Special attributes on tomato template elements
+// Special attributes on tomato template elements. The ones starting with an underscore have their
+// prefix swapped out for GeneratorOptions.SpecialPrefix when one is configured.
 const (
 	FieldRefAttr    = "_ref"
 	MockAttr        = "_ignorecontent"
@@ -29,40 +96,561 @@ const (
 	IdAttr          = "id"
 	DebugIdAttr     = "debug-id"
 	StripMeAttr     = "_stripme"
+	ExtendsAttr     = "_extends"
+	RawAttrPrefix   = "_raw:" // _raw:data-json="..." keeps the value exactly as written, entities and all.
+
+	// On a template's root, declares that the view takes a className constructor argument which is
+	// merged into the root's classes. A class on a tomato element referencing such a view is passed
+	// through it, rather than replacing the nested root's class.
+	AcceptsClassAttr = "_acceptsclass"
+
+	// Defers building an element (which needs a _ref) until its ref is first accessed.
+	LazyAttr = "_lazy"
+
+	// _on:click="handleClick" calls the view's handleClick method with click events. The view declares
+	// the handlers it expects, typed by their events, for subclasses to implement.
+	EventAttrPrefix = "_on:"
+
+	// On a template's root, declares the view's props as TypeScript members separated by semicolons,
+	// e.g. _props="title: string; count?: number". They're passed to the constructor in an options
+	// object (see ConstructorStyle), which the constructor's code (such as the conditions of conditional
+	// attributes) reads them from as opts.title. Attributes of a tomato element referencing such a view
+	// that are named after its props (in any case, since attribute names are lower cased) are passed as
+	// props rather than set on its root: as literals for number and boolean props, whose values have to
+	// be ones, and as strings otherwise. Leaving out a prop that isn't optional fails generation.
+	PropsAttr = "_props"
+
+	// On a template's root, emits that view in StatementStyle whatever the options say, for views too
+	// complex to debug as one long chain.
+	StatementsAttr = "_statements"
+
+	// On a template's root, the key the view registers itself under with the RegisterFunction, in place
+	// of its name.
+	RegisterAsAttr = "_registeras"
 )
 
+// Placeholder element in a layout template marking where an extending template's root goes.
+const LayoutContentTag = "content"
+
 // TODO(jaime): Wish I could make this const
 // List of attributes we do not forward into the generated JSX.
-var blockedAttrs = []string{FieldRefAttr, MockAttr /*, IdAttr */}
+var blockedAttrs = []string{FieldRefAttr, MockAttr, ExtendsAttr, AcceptsClassAttr, LazyAttr, PropsAttr, StatementsAttr, RegisterAsAttr /*, IdAttr */}
 
 type TomatoGenerator interface {
 	GenerateViews(files *list.List, forceDebugIds bool) (map[string]*View, error)
 	EmitPreamble(buffer *bytes.Buffer)
 	EmitPostamble(buffer *bytes.Buffer)
-	generateView(fileName string, forceDebugIds bool) (string, string, error)
+	generateViews(templates *list.List, forceDebugIds bool) (map[string]*View, error)
+	generateView(t *template, forceDebugIds bool) (*View, error)
+	emitImport(buffer *bytes.Buffer, viewNames []string, from string)
+	emitPreamble(buffer *bytes.Buffer, imports []runtimeImport)
+	emitRegistry(buffer *bytes.Buffer, viewNames []string)
+	emitViewNameEnum(buffer *bytes.Buffer, viewNames []string)
+	emitHotModuleReplacement(buffer *bytes.Buffer, moduleId string)
+
+	// Formats text as a comment on a line of its own in the generated language.
+	commentLine(text string) string
 }
 
 type View struct {
 	ViewText string
 	CssText  string
+
+	Stats ViewStats
+
+	nestedViews []string // Names of the views nested in this one.
+	classNames  []string
+	registerKey string            // The key the view registers under, when there's a RegisterFunction.
+	opts        *GeneratorOptions // The options the view was generated with, overrides included.
+}
+
+// The size of a generated view, as counted while generating it.
+type ViewStats struct {
+	Elements      int // Elements built, nested tomato elements included.
+	MaxDepth      int // Depth of the most deeply nested element, the root's being 0.
+	Refs          int
+	NestedTomatos int // References to nested tomatos, inlined ones included.
+}
+
+// Totals over a set of generated views, for keeping an eye on the health of a template corpus.
+type Stats struct {
+	Views         int
+	Elements      int
+	Refs          int
+	NestedTomatos int
+	ViewsWithCss  int
+	MaxDepth      int
+	DeepestView   string // Path of the template with the most deeply nested element.
+}
+
+// Totals the stats of views keyed by their template paths, like GenerateViews returns them.
+func CollectStats(views map[string]*View) Stats {
+	paths := make([]string, 0, len(views))
+	for path := range views {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var stats Stats
+	for _, path := range paths {
+		view := views[path]
+		stats.Views++
+		stats.Elements += view.Stats.Elements
+		stats.Refs += view.Stats.Refs
+		stats.NestedTomatos += view.Stats.NestedTomatos
+		if strings.TrimSpace(view.CssText) != "" {
+			stats.ViewsWithCss++
+		}
+		if stats.DeepestView == "" || view.Stats.MaxDepth > stats.MaxDepth {
+			stats.MaxDepth = view.Stats.MaxDepth
+			stats.DeepestView = path
+		}
+	}
+	return stats
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d views, %d elements, %d refs, %d nested tomatos, %d views with css, deepest nesting %d (%s)",
+		s.Views, s.Elements, s.Refs, s.NestedTomatos, s.ViewsWithCss, s.MaxDepth, s.DeepestView)
 }
 
 type GeneratorOptions struct {
 	ViewBaseClass  string
 	ViewFactory    string
 	ImportLocation string
+
+	// Output normalization, applied to the generated files right before they are written.
+	NormalizeNewlines bool // Convert CRLF and lone CR line endings to LF.
+	TrailingNewline   bool // End each non-empty file with exactly one newline.
+
+	// Start each generated file with a comment naming the tomato Version that generated it and, when
+	// HeaderTimestamp, the time it was generated at. A file whose timestamp is all that changed isn't
+	// rewritten, so regenerating stays idempotent.
+	Header          bool
+	HeaderTimestamp bool
+
+	// Where the views' Css goes. Rather than to the stylesheet next to the views, it can be injected
+	// by the views themselves, once per view class however many instances there are, so that their
+	// Css comes with them. The Css is injected as it's written, so it has to be plain Css, with
+	// <style scoped> blocks scoped by ScopeAttribute rather than nested for SCSS.
+	InjectCss CssInjection
+
+	// A view method data-* attributes are set through instead of setAttr, with the key their dataset
+	// property goes by, data-user-id="7" becoming .setData('userId', '7'). Empty sets them as attributes.
+	DatasetMethod string
+
+	// Whether or not each element, nested view, split out build's result and fragment is checked to have
+	// no parent yet before it's appended, by passing it to AppendGuardFunction (assertDetached by
+	// default, imported from the ImportLocation), which catches views that attach themselves elsewhere.
+	// Like the DevRefGuards' warnings, the checks are behind the DevGuard, for bundlers to strip from
+	// production builds. Requires the StatementStyle.
+	AppendGuards        bool
+	AppendGuardFunction string
+
+	// Whether the refs of plain elements hold their views, their raw elements or both, sparing the
+	// .elem() at every use of the element. Element refs are named after the ref with ElementRefSuffix
+	// (El by default) appended, _ref="header" making headerEl, and generation fails when that's another
+	// ref's name. Nested views and _lazy elements keep their view refs. Requires the StatementStyle and
+	// field refs.
+	ElementRefs      ElementRefs
+	ElementRefSuffix string
+
+	// Emit a hydrate(root) method that wires up the refs from an already rendered (e.g. server side)
+	// DOM tree instead of constructing it.
+	Hydrate bool
+
+	RefStyle RefStyle
+
+	// When set, class attribute values are mapped through the styles object imported from this
+	// location (CSS modules), e.g. class="btn" becomes styles.btn.
+	ClassModule     string
+	ClassModuleName string // The name the styles object is imported under. Defaults to "styles".
+
+	Logger *Logger
+
+	// Emit the DOM construction as a statement per element, rather than as one big expression chain.
+	// Required for conditional attributes.
+	StatementStyle bool
+
+	// Set all of an element's attributes with a single call taking an object literal, rather than a
+	// chain of setAttr calls.
+	BulkAttrs       bool
+	BulkAttrsMethod string // Defaults to "setAttrs".
+
+	// Prefix for the special template attributes (_ref, _id, _ignorecontent, ...), for teams whose own
+	// attributes already use underscores. Defaults to "_".
+	SpecialPrefix string
+
+	// Elements with at least this many element children build them in a DocumentFragment that is appended
+	// once. Zero disables fragments.
+	FragmentThreshold int
+	FragmentFactory   string // Defaults to "createFragment".
+
+	// When set, views are generated as MyViewBase classes and a MyView subclass stub for developers to
+	// customize is scaffolded into this directory, unless it already exists. The stubs import the
+	// generated file, so rather than it importing them back, each stub hands its subclass to the Base
+	// class's static subclass, which nested views are built as, and registers it with the
+	// RegisterFunction.
+	ScaffoldDir string
+
+	// Nested tomatos whose templates have at most this many elements are inlined into the referencing
+	// view instead of being instantiated. Zero disables inlining.
+	InlineThreshold int
+
+	// How deep nested tomatos may be built into each other, whether inlined or instantiated, before
+	// generation fails with the chain of templates. Recursive tomatos always fail unless they're _lazy.
+	// Defaults to DefaultMaxIncludeDepth.
+	MaxIncludeDepth int
+
+	// What goes between consecutive views, and between consecutive views' Css. Both default to "\n\n"
+	// when nil, and can point at "" to run the entries together.
+	ViewSeparator *string
+	CssSeparator  *string
+
+	// When positive, views are written to a file per directory group rather than all to the one output
+	// file. Groups are the first GroupByDepth directories of a template's path below the input folder,
+	// e.g. with a depth of 1, views under cart/** go to cart.ts next to the output file.
+	GroupByDepth int
+
+	// Maps a template's path to the name of its view, in place of the default of the PascalCased file
+	// name plus "View". Nested tomatos are named from their resolved paths.
+	ViewNameFunc func(path string) string
+
+	// Whether or not view names that aren't valid class names (2fa.htmto's 2faView, my-card.htmto's
+	// My-cardView) are made into ones, by dropping the invalid characters and upper casing what follows
+	// them, rather than being an error. Names starting with a digit get a leading underscore.
+	SanitizeViewNames bool
+
+	// Emit an exported MyViewRefs interface per view describing its refs.
+	EmitRefsInterface bool
+
+	LintAria bool // Warn about unknown roles, misspelled aria-* attributes and unnamed icon buttons.
+
+	// Treat generation warnings as errors.
+	Strict bool
+
+	// Leave a TODO comment on elements marked with _ignorecontent, so unfinished views get noticed.
+	MockTodos bool
+
+	// Build each direct child of the root that has children of its own in a private method called from
+	// the constructor, rather than all in the one constructor, so bundlers can drop the unused ones.
+	SplitConstruction bool
+
+	// The attribute forced debug ids are set on, e.g. "data-testid". Defaults to "debug-id".
+	DebugIdAttr string
+
+	// Templates that are only text (no root element) get wrapped in an element with this tag, e.g.
+	// "span". When empty, such templates are an error.
+	TextRootTag string
+
+	// Templates with several root elements (a list of elements meant to be a slot's content, say) get
+	// wrapped in an element with this tag, so they still make a single view. When empty, more than one
+	// root is an error.
+	FragmentRootTag string
+
+	// Relative URLs in asset attributes are resolved against the template referencing them and rewritten
+	// to AssetBaseURL plus their path within AssetRoot. E.g. with an AssetRoot of "web" and a base of
+	// "/static", src="../img/logo.png" in web/cart/cart.htmto becomes "/static/img/logo.png". Empty
+	// disables rewriting.
+	AssetBaseURL string
+	AssetRoot    string   // Defaults to the working directory.
+	AssetAttrs   []string // Defaults to src and href.
+
+	// Emit an exported map from a tag for each view (its kebab-cased name without the View suffix) to
+	// its class, for instantiating views by name at runtime.
+	EmitRegistry bool
+	RegistryName string // Defaults to "views".
+
+	// Emit inline style attributes as a call per property, e.g. .setCss('color', 'red'), rather than as one
+	// opaque string.
+	SplitStyles bool
+	StyleMethod string // Defaults to "setCss".
+
+	// Attribute names (lower case) mapped to the type their values are checked as: AttrNumber,
+	// AttrBoolean or AttrString. Attributes that aren't listed are strings. Values are still set as
+	// strings, since attributes are strings: numbers are checked and trimmed, and booleans are set to ''
+	// or, when written as "false", left out, as it's their presence that counts. See DefaultAttrTypes.
+	AttrTypes map[string]string
+
+	// Templates are parsed as HTML fragments in the context of this element. Defaults to "body". Table
+	// parts (tr, td, ...) are parsed in the context of the element they belong in instead.
+	ParseContext string
+
+	// Parse templates as whole documents and use the first node of the body, as tomato originally did,
+	// rather than as fragments.
+	DocumentParsing bool
+
+	// Set an attribute naming the view on every root, for finding which view owns a DOM subtree in the
+	// browser's devtools. Meant for development builds. Views with <style scoped> Css always get it,
+	// since their Css is nested under it.
+	TagRoot     bool
+	TagRootAttr string // Defaults to "data-view".
+
+	// Code inserted into every constructor, {{view}} being replaced with the view's name. The prologue
+	// can't come before the call to super, so it goes right after it, ahead of the DOM construction. The
+	// epilogue goes at the very end, once the DOM is complete, e.g. "this.init();".
+	ConstructorPrologue string
+	ConstructorEpilogue string
+
+	// The order views are written out in. Whichever it is, the order is fully determined by the
+	// templates' paths.
+	SortOrder SortOrder
+
+	// Called with each view as soon as it's generated, before the views are combined and written. Calls
+	// are made one at a time, in the order the templates were found (once per target when generating
+	// several). The view must not be modified.
+	OnViewGenerated func(name, path string, v *View)
+
+	// Tag names (lower case) mapped to the function their elements are created with, in place of the
+	// ViewFactory. The function is imported from the ImportLocation and called as factory(attrs, doc),
+	// attrs being an object of the element's plain attributes, e.g. createIcon({'name': 'close'}, doc).
+	// Conditional, namespaced and split style attributes are still set on the view it returns.
+	TagFactories map[string]string
+
+	// A policy on the attributes that make it into the generated views. Attributes are matched by
+	// name (lower case), a trailing * matching any suffix, e.g. "on*" or "data-*". When AllowedAttrs
+	// isn't empty only the attributes it matches are kept, and those DeniedAttrs matches are never kept.
+	// Dropped attributes are warned about (errors under Strict). The policy applies to the attributes
+	// tomato adds itself too: forced debug-ids, TagRoot's attribute and the scope attributes.
+	AllowedAttrs []string
+	DeniedAttrs  []string
+
+	// Emit a static debugRefs map on each view from the debug-ids of its elements to the names of their
+	// refs, for tests that find elements by debug-id to get at their typed refs.
+	EmitDebugRefs bool
+
+	// Re-export the view base class and factory from the generated files, so code handed views (and
+	// refs typed as the base class) doesn't also have to import the view library.
+	ReexportBase bool
+
+	// Warn about chains of more than this many nested wrapper elements, each holding nothing but the
+	// next (<div><div><div>...), which are usually worth simplifying. 0 disables the check.
+	MaxWrapperDepth int
+
+	// End each generated file with hot module replacement boilerplate for dev servers: a comment with
+	// a module id that stays the same from one run to the next (the output file's path), followed by
+	// HotAccept. The generated modules are ES modules, so the default relies on import.meta.hot.
+	HotModuleReplacement bool
+	HotAccept            string // Defaults to "if (import.meta.hot) {\n  import.meta.hot.accept();\n}".
+
+	// Build each view's DOM once, keeping a copy of it as the view's template, and construct the
+	// following instances (from the same document) by cloning the template and wiring up their refs
+	// and listeners through hydrate, which is always emitted. Meant for views that are instantiated
+	// many times. Since every instance is a copy of the first, templates can't have conditional
+	// attributes or _lazy elements, and whatever tag factories do beyond building their elements is
+	// lost on the copies.
+	CloneStrategy bool
+
+	// Constructors only create the root (the view's shell), leaving its attributes and children to an
+	// async method named AsyncBuildMethod (buildAsync by default), which builds them in the next
+	// animation frame to keep views off the critical path. Refs are optional until then. Can't be
+	// combined with the CloneStrategy, _props or _lazy elements. The epilogue still runs in the
+	// constructor.
+	AsyncBuild       bool
+	AsyncBuildMethod string
+
+	// Comment each element's construction with the template file and line it comes from, e.g.
+	// "// views/card.htmto:12". Elements of inlined templates aren't commented.
+	LineComments bool
+
+	// Emit a static classes map on each view from the class names its template uses to their values,
+	// which are the names themselves unless they're mapped through a ClassModule. Runtime code toggles
+	// MyView.classes.active rather than a string that can drift from the template.
+	EmitClassNames bool
+
+	// Check the markup of the templates before parsing, which otherwise silently "fixes" it, for
+	// unknown tags (typos like <spam>) and end tags that don't match the elements they close. Problems
+	// are warnings, or errors when Strict. Tags with a dash (custom elements) and TagFactories tags count
+	// as known.
+	StrictMarkup bool
+
+	// Check the templates' <style> blocks for unbalanced braces, unterminated strings and comments, and
+	// blocks that are never closed, which otherwise only break once the stylesheet is compiled. Problems
+	// are warnings, or errors when Strict.
+	ValidateCss bool
+
+	// How views' Css is scoped to them. Under ScopeAttribute every selector in a view's Css, scoped
+	// block or not, is made to match only the element with [data-s="<id>"] and its descendants, the id
+	// being a hash of the view name (so stable across runs), and the view's root gets that attribute.
+	// Rules inside @media, @supports and the like are scoped too, while those of other at-rules, like
+	// @keyframes, are left alone. Blocks marked <style global> (resets, themes) are never scoped,
+	// whatever the strategy.
+	ScopeStrategy ScopeStrategy
+
+	// How the views take the props declared by their templates' _props. Views with props get a
+	// constructor(opts: MyViewOptions, doc: Document = document) under ConstructorOptions, along with
+	// the MyViewOptions interface.
+	ConstructorStyle ConstructorStyle
+
+	// A regular expression for include comments, whose first group is the path of the included template,
+	// e.g. DefaultIncludePattern. Matching comments are treated as <tomato src="path"></tomato> (or the
+	// IncludeTag), so the included templates are nested (or inlined) views. Empty disables include comments.
+	IncludePattern string
+
+	// The tag of the elements nesting other templates, <tomato src="..."> by default. Something else,
+	// like include or t:view, for projects using <tomato> for other things.
+	IncludeTag string
+
+	// Attribute names (lower case) mapped to the string enums their values are members of, e.g. "role"
+	// to "Role", so that role="button" is set as Role.Button and typos fail to compile. Members are
+	// the values in PascalCase, split on anything that isn't a letter or digit (aria-live="polite" is
+	// AriaLive.Polite). The enums are imported from EnumsImportLocation, which defaults to the
+	// ImportLocation.
+	AttrEnums           map[string]string
+	EnumsImportLocation string
+
+	// ESLint rules to disable for the generated files, through an /* eslint-disable ... */ comment at the
+	// top of each. "*" disables all of them.
+	EslintDisable []string
+
+	// Whether or not to put a // prettier-ignore comment ahead of each generated class.
+	PrettierIgnore bool
+
+	// Whether or not to set each element's attributes in sorted order rather than in source order, so
+	// that formatters reordering them don't churn the generated code. Attributes tomato adds itself,
+	// like forced debug-ids, aren't sorted in and keep their place ahead of the element's own.
+	SortAttrs bool
+
+	// Whether or not refs that can be unset (those inside _lazy elements, or of an AsyncBuild) are
+	// accessors that warn when they're read while unset. The warnings only happen when DevGuard, an
+	// expression for bundlers to strip from production builds, holds. It defaults to
+	// process.env.NODE_ENV !== 'production'. Only applies to RefFields.
+	DevRefGuards bool
+	DevGuard     string
+
+	// Whether or not to write the class names used by the views, deduplicated and sorted, as the typings
+	// of a CSS module's default export next to each stylesheet (views.scss.d.ts for views.scss), for code
+	// importing the stylesheet as a module.
+	EmitCssTypes bool
+
+	// A text/template the generated classes are written out through, for wrapping them in decorators,
+	// registration calls and the like. It's executed with the class's ClassParts, and
+	// DefaultClassTemplate writes them the way they are without one.
+	ClassTemplate string
+
+	// A method of the view base class that text is handed to, trimmed, when it's all the root has
+	// (<button>Submit</button>), rather than being appended as a text node. For base classes with a
+	// label of their own, e.g. setLabel. Like appendText, it has to return the view. Empty appends the
+	// text.
+	RootTextSetter string
+
+	// A function each view is registered with right after its class, as registerView('MyView', MyView),
+	// so that importing a view's module is enough for it to be found by key (the view name, or its root's
+	// _registeras). Imported from RegisterImportLocation, which defaults to the ImportLocation. Empty
+	// disables registration.
+	RegisterFunction       string
+	RegisterImportLocation string
+
+	// Whether or not to leave out attributes written with an empty value, like class="", rather than
+	// setting them to ''. Boolean attributes (those of AttrTypes or DefaultAttrTypes), whose presence is
+	// what counts, are still set.
+	SkipEmptyAttrs bool
+
+	// Whether or not nested views with a ref are registered with the view building them, as
+	// this.addChild(this.card = new CardView(doc)), for base classes that cascade disposal and updates
+	// down to their children. AddChildMethod names the base class method, which defaults to addChild and
+	// has to return the child it's given.
+	TrackChildren  bool
+	AddChildMethod string
+
+	// Whether or not nested views are handed the view building them, as
+	// new CardView(doc).setParent(this), for tooling walking up the tree of views. SetParentMethod names
+	// the method, which defaults to setParent and, like the setters, has to return the view.
+	LinkParents     bool
+	SetParentMethod string
+
+	// Whether or not the construction of each view's attributes and children is wrapped in a try block
+	// that calls CleanupMethod (dispose by default) before rethrowing whatever was thrown, so that views
+	// whose factories acquire resources don't leak them when construction fails partway. Requires the
+	// StatementStyle.
+	ConstructorGuard bool
+	CleanupMethod    string
+
+	// The function the Hyperscript language builds elements with, imported from the ImportLocation.
+	// Defaults to h.
+	HyperscriptFunction string
+
+	// Whether or not templates wrapping their root in a _stripme element are warned about (or, when
+	// Strict, fail), now that table parts can be roots without the wrapper. The wrapper is still
+	// stripped either way.
+	DeprecateStripMe bool
+
+	// Whether or not attributes written without a value (<input disabled>) are treated as booleans,
+	// set to '' like AttrBoolean attributes are, whatever their AttrTypes and even when SkipEmptyAttrs.
+	// Attributes written with an empty value (disabled="") are left as they are.
+	BareAttrsAsBooleans bool
+
+	// Emit an exported string enum of the names of the views, in the order they're written in,
+	// MyView = 'MyView', as the one typed list of the valid view names. Under GroupByDepth it lists the
+	// views of every group, in the output file itself.
+	EmitViewNameEnum bool
+	ViewNameEnum     string // Defaults to "ViewName".
+
+	sources map[string]string // Template contents by cleaned path, read rather than the files when set.
+}
+
+// The parts of a generated class, as the ClassTemplate sees them. Each part that isn't empty starts with
+// a newline, like everything else tomato emits.
+type ClassParts struct {
+	Name         string // The class name.
+	BaseClass    string
+	Implements   string // The interface the class implements, if any.
+	Declarations string // What goes ahead of the class, like the interface of its refs.
+	Refs         string // The field declarations.
+	Construction string // The constructor and the rest of the methods.
+}
+
+// Reproduces the classes generated without a ClassTemplate.
+const DefaultClassTemplate = `{{.Declarations}}
+export class {{.Name}} extends {{.BaseClass}}{{if .Implements}} implements {{.Implements}}{{end}} {{"{"}}{{.Refs}}{{.Construction}}
+}
+`
+
+// Matches server side include comments, <!--#include file="header.htmto" --> (or virtual="...").
+const DefaultIncludePattern = `<!--#include\s+(?:file|virtual)="([^"]*)"\s*-->`
+
+// The default GeneratorOptions.MaxIncludeDepth.
+const DefaultMaxIncludeDepth = 16
+
+// Attribute value types for GeneratorOptions.AttrTypes.
+const (
+	AttrString  = "string"
+	AttrNumber  = "number"
+	AttrBoolean = "boolean"
+)
+
+// The types of the common numeric and boolean HTML attributes, as a starting point for AttrTypes.
+var DefaultAttrTypes = map[string]string{
+	"tabindex":  AttrNumber,
+	"colspan":   AttrNumber,
+	"rowspan":   AttrNumber,
+	"maxlength": AttrNumber,
+	"minlength": AttrNumber,
+	"size":      AttrNumber,
+	"span":      AttrNumber,
+	"rows":      AttrNumber,
+	"cols":      AttrNumber,
+	"start":     AttrNumber,
+	"checked":   AttrBoolean,
+	"disabled":  AttrBoolean,
+	"hidden":    AttrBoolean,
+	"multiple":  AttrBoolean,
+	"readonly":  AttrBoolean,
+	"required":  AttrBoolean,
+	"selected":  AttrBoolean,
 }
 
 type viewGenerator interface {
 	// Visitor to build up the string
 	head(node *html.Node, depth int) error
 	tail(node *html.Node, depth int)
-	transferAttrs(node *html.Node)
+	transferAttrs(node *html.Node, builder *stringBuilder) error
 
 	// View emitting.
 	emitPreamble()
 	emitElementRefs()
 	emitDomConstruction()
+	emitHydration()
 	emitPostamble()
 	getView() string
 
@@ -76,12 +664,201 @@ type visitorData struct {
 
 	cssText         string
 	viewName        string
+	fileName        string
+	templates       *templateCache
 	output          stringBuilder
 	domConstruction stringBuilder
+	hydration       stringBuilder
+	root            *html.Node
+	rootRef         string
+	acceptsClass    bool
+	passedClass     *html.Node // Tomato element whose class goes to the nested view's constructor.
+	passedProps     *html.Node // Tomato element whose props go to the nested view's constructor.
+	props           []prop
 	ignoreSubtree   bool
 	forceDebugIds   bool
 	refs            list.List
+	nestedViews     []string
 	appendStack     list.List
+	fragmentParents []*html.Node
+
+	// Statement style state.
+	varStack         list.List
+	varCount         int
+	conditionalAttrs []conditionalAttr
+	elementRef       string   // Element ref of the element being declared.
+	refNames         []string // The template's own refs, which element refs mustn't collide with.
+
+	handlers []eventHandler
+
+	stats ViewStats
+
+	debugRefs  [][2]string // Debug-id and ref name pairs.
+	classNames []string
+	lines      sourceLines
+	bareAttrs  bareAttrs
+
+	constructionStart int // Where the construction of the root's attributes and children starts.
+
+	// Where the class, its fields, its methods and its end start in the output, for the ClassTemplate.
+	classStart, refsStart, methodsStart, classEnd int
+
+	// Nested tomato inlining state.
+	inlineChain     []string
+	inlinedTomatoes []*html.Node
+
+	// Split construction state.
+	splits       []*buildSplit // The elements being built in their own methods, innermost last.
+	splitCount   int
+	lazyRefs     []*buildSplit
+	buildMethods stringBuilder
+}
+
+// An element built in its own method rather than in the constructor.
+type buildSplit struct {
+	node    *html.Node
+	method  string
+	start   int    // Where the method's body starts in domConstruction.
+	lazyRef string // The ref building the element on first access, for lazy elements.
+	refType string
+
+	enclosingLazyRef string // The innermost lazy element this one is built inside of.
+}
+
+// What's appended in place of the split element.
+func (split *buildSplit) placeholder() string {
+	if split.lazyRef != "" {
+		return "this._" + split.lazyRef + "Anchor = doc.createComment('" + escapeText(split.lazyRef) + "')"
+	}
+	return "this." + split.method + "(doc)"
+}
+
+// A prop declared by a template's _props.
+type prop struct {
+	name     string
+	decl     string // The whole member declaration, e.g. "count?: number".
+	typ      string // The declared type, empty when there isn't one.
+	optional bool
+}
+
+func parseProps(declarations string) []prop {
+	var props []prop
+	for _, decl := range strings.Split(declarations, ";") {
+		if decl = strings.TrimSpace(decl); decl == "" {
+			continue
+		}
+		name, typ := decl, ""
+		if colon := strings.Index(decl, ":"); colon >= 0 {
+			name, typ = strings.TrimSpace(decl[:colon]), strings.TrimSpace(decl[colon+1:])
+		}
+		optional := strings.HasSuffix(name, "?")
+		props = append(props, prop{strings.TrimSpace(strings.TrimSuffix(name, "?")), decl, typ, optional})
+	}
+	return props
+}
+
+// Whether a tomato element's attribute is passed to its view as a prop.
+func (v *typeScriptVisitor) isPassedProp(node *html.Node, key string) bool {
+	t, err := v.templates.load(resolveSrc(v.currentFile(), getAttr(node, "src")))
+	if err != nil || t.root == nil {
+		return false
+	}
+	for _, prop := range parseProps(getAttr(t.root, v.specialAttr(PropsAttr))) {
+		if strings.EqualFold(prop.name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// The tomato element's attribute passing the prop, if it has one.
+func propAttr(node *html.Node, p prop) (html.Attribute, bool) {
+	for _, attr := range node.Attr {
+		if attr.Namespace == "" && strings.EqualFold(attr.Key, p.name) {
+			return attr, true
+		}
+	}
+	return html.Attribute{}, false
+}
+
+// The expression passing an attribute's value as the prop, a literal of the prop's type for numbers and
+// booleans and a string otherwise.
+func (v *typeScriptVisitor) propValueExpr(node *html.Node, p prop, val string) (string, error) {
+	switch p.typ {
+	case "number":
+		if n, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+			return strings.TrimSpace(val), nil
+		}
+	case "boolean":
+		// Like boolean attributes, written without a value is true.
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "", "true", strings.ToLower(p.name):
+			return "true", nil
+		case "false":
+			return "false", nil
+		}
+	default:
+		return "'" + escapeText(val) + "'", nil
+	}
+	return "", fmt.Errorf("%s: %s: prop %s is a %s, '%s' isn't one", v.fileName, describeElement(v.root, node), p.name, p.typ, val)
+}
+
+// A view method that events are forwarded to, with the type of the events.
+type eventHandler struct {
+	method    string
+	eventType string
+}
+
+func indexOfHandler(handlers []eventHandler, method string) int {
+	for i, handler := range handlers {
+		if handler.method == method {
+			return i
+		}
+	}
+	return -1
+}
+
+// An attribute that is only set at runtime when its condition is truthy.
+type conditionalAttr struct {
+	condition string
+	setter    string
+}
+
+// Whether an attribute tomato adds itself passes the AllowedAttrs and DeniedAttrs policy, warning when
+// it's dropped the same as the template's own attributes.
+func (v *visitorData) addedAttrAllowed(node *html.Node, key string) (bool, error) {
+	if v.attrAllowed(key) {
+		return true, nil
+	}
+	return false, v.warn(node, "attribute "+key+" isn't allowed, dropping it")
+}
+
+// Reports a problem with an element of the template. It's logged as a warning, or returned as an error
+// when generating in strict mode.
+func (v *visitorData) warn(node *html.Node, problem string) error {
+	d := Diagnostic{File: v.fileName, Message: describeElement(v.root, node) + ": " + problem}
+	if file, line, ok := v.lines.position(node); ok {
+		d.File, d.Line = file, line // The element may come from a layout or an inlined template.
+	}
+	if v.Strict {
+		d.Severity = SeverityError
+		return &d
+	}
+	v.Logger.Warn(d)
+	return nil
+}
+
+// Reports the problems found in a template as warnings or, when Strict, returns the first as an error.
+func (opts *GeneratorOptions) reportProblems(fileName string, problems []Diagnostic) error {
+	for _, problem := range problems {
+		problem.File = fileName
+		if opts.Strict {
+			problem.Severity = SeverityError
+			return &problem
+		}
+		opts.Logger.Warn(problem)
+	}
+	return nil
 }
 
 // Factory method for obtaining a TomatoGenerator
@@ -89,7 +866,11 @@ func MakeTomatoGenerator(language Language, opts *GeneratorOptions) (TomatoGener
 	// TODO(jaime): Support the other languages. Someday over the rainbow.
 	switch language {
 	case TypeScript:
-		return &typeScriptGenerator{opts}, nil
+		return &typeScriptGenerator{GeneratorOptions: opts}, nil
+	case HTML:
+		return &htmlGenerator{GeneratorOptions: opts}, nil
+	case Hyperscript:
+		return &hyperscriptGenerator{GeneratorOptions: opts}, nil
 	default:
 		return nil, errors.New("Language not supported")
 	}
@@ -111,293 +892,3023 @@ func (builder *stringBuilder) append(text string) *stringBuilder {
 
 type typeScriptVisitor struct {
 	visitorData // inherits
+
+	generator *typeScriptGenerator
 }
 
 type typeScriptGenerator struct {
 	*GeneratorOptions //inherits
+
+	templates *templateCache
 }
 
 func (g *typeScriptGenerator) EmitPreamble(buffer *bytes.Buffer) {
-	buffer.WriteString("import { ")
-	buffer.WriteString(g.ViewBaseClass)
-	buffer.WriteString(", ")
-	buffer.WriteString(g.ViewFactory)
-	buffer.WriteString(" } from '")
-	buffer.WriteString(g.ImportLocation)
-	buffer.WriteString("';")
+	g.emitPreamble(buffer, runtimeImportsOf(nil, g.GeneratorOptions))
+}
+
+func (g *typeScriptGenerator) emitPreamble(buffer *bytes.Buffer, imports []runtimeImport) {
+	if len(g.EslintDisable) > 0 {
+		buffer.WriteString("/* eslint-disable")
+		if !contains(g.EslintDisable, "*") {
+			buffer.WriteString(" ")
+			buffer.WriteString(strings.Join(g.EslintDisable, ", "))
+		}
+		buffer.WriteString(" */\n")
+	}
+
+	for i, runtime := range imports {
+		if i > 0 {
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString("import { ")
+		buffer.WriteString(strings.Join(runtime.names, ", "))
+		buffer.WriteString(" } from '")
+		buffer.WriteString(runtime.from)
+		buffer.WriteString("';")
+	}
+
+	if g.ReexportBase {
+		for _, runtime := range imports {
+			if len(runtime.bases) == 0 {
+				continue // Enums and register functions aren't reexported.
+			}
+			buffer.WriteString("\nexport { ")
+			buffer.WriteString(strings.Join(runtime.bases, ", "))
+			buffer.WriteString(" } from '")
+			buffer.WriteString(runtime.from)
+			buffer.WriteString("';")
+		}
+	}
+
+	if g.ClassModule != "" {
+		buffer.WriteString("\nimport ")
+		buffer.WriteString(g.classModuleName())
+		buffer.WriteString(" from '")
+		buffer.WriteString(g.ClassModule)
+		buffer.WriteString("';")
+	}
 }
 
 func (g *typeScriptGenerator) GenerateViews(files *list.List, forceDebugIds bool) (map[string]*View, error) {
+	templates, err := loadTemplates(files, g.GeneratorOptions)
+	if err != nil {
+		return nil, err
+	}
+	return g.generateViews(templates, forceDebugIds)
+}
+
+func (g *typeScriptGenerator) generateViews(templates *list.List, forceDebugIds bool) (map[string]*View, error) {
+	g.templates = newTemplateCache(templates, g.GeneratorOptions)
 	views := make(map[string]*View)
-	for e := files.Front(); e != nil; e = e.Next() {
-		file := e.Value.(string)
-		view, css, err := g.generateView(file, forceDebugIds)
+	for e := templates.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*template)
+		view, err := g.generateView(t, forceDebugIds)
 		if err != nil {
 			return nil, err
 		}
-		views[file] = &View{
-			ViewText: view,
-			CssText:  css,
+		views[t.fileName] = view
+		g.Logger.Infof("generated %s from %s", g.viewName(t.fileName), t.fileName)
+		if g.OnViewGenerated != nil {
+			g.OnViewGenerated(g.viewName(t.fileName), t.fileName, view)
+		}
+	}
+	return views, nil
+}
+
+func (*typeScriptGenerator) EmitPostamble(buffer *bytes.Buffer) {
+}
+
+func (g *typeScriptGenerator) generateView(t *template, forceDebugIds bool) (*View, error) {
+	if g.templates == nil {
+		g.templates = newTemplateCache(list.New(), g.GeneratorOptions)
+	}
+
+	opts, err := g.withOverrides(t.overrides)
+	if err != nil {
+		return nil, err
+	}
+	if t.root != nil && hasAttrKey(t.root, opts.specialAttr(StatementsAttr)) && !opts.StatementStyle {
+		statementOpts := *opts
+		statementOpts.StatementStyle = true
+		opts = &statementOpts
+	}
+	if viewName := g.viewName(t.fileName); !isIdentifier(viewName) {
+		return nil, fmt.Errorf("%s: the view name %s isn't a valid class name, rename the template or set SanitizeViewNames", t.fileName, viewName)
+	}
+	if opts.ConstructorGuard && !opts.StatementStyle {
+		return nil, fmt.Errorf("%s: ConstructorGuard needs the StatementStyle", t.fileName)
+	} else if opts.AppendGuards && !opts.StatementStyle {
+		return nil, fmt.Errorf("%s: AppendGuards needs the StatementStyle", t.fileName)
+	} else if opts.ElementRefs != ViewRefs && (!opts.StatementStyle || opts.RefStyle == RefMap) {
+		return nil, fmt.Errorf("%s: ElementRefs needs the StatementStyle and field refs", t.fileName)
+	}
+	if opts.AsyncBuild && opts.CloneStrategy {
+		return nil, fmt.Errorf("%s: AsyncBuild can't be combined with the CloneStrategy", t.fileName)
+	}
+	visitor := typeScriptVisitor{visitorData: visitorData{
+		GeneratorOptions: opts,
+		forceDebugIds:    forceDebugIds,
+		viewName:         g.viewName(t.fileName),
+		fileName:         t.fileName,
+		templates:        g.templates,
+		lines:            t.lines,
+		bareAttrs:        t.bareAttrs,
+	}, generator: g}
+
+	if err := g.templates.checkNesting(t.fileName); err != nil {
+		return nil, err
+	}
+	if err := walk(t, &visitor); err != nil {
+		return nil, err
+	}
+
+	viewText := generateView(&visitor)
+	if opts.ClassTemplate != "" {
+		if viewText, err = visitor.executeClassTemplate(viewText); err != nil {
+			return nil, err
+		}
+	}
+	registerKey := ""
+	if opts.RegisterFunction != "" {
+		if registerKey = getAttr(t.root, opts.specialAttr(RegisterAsAttr)); registerKey == "" {
+			registerKey = visitor.viewName
+		}
+		if opts.ScaffoldDir == "" { // Otherwise the stub registers the subclass.
+			viewText += opts.RegisterFunction + "('" + escapeText(registerKey) + "', " + visitor.className(visitor.viewName) + ");\n"
+		}
+	}
+
+	// Generate the View and return it.
+	cssText := visitor.getCss()
+	if opts.InjectCss != CssFile {
+		cssText = "" // The view brings its own.
+	}
+	return &View{
+		ViewText:    viewText,
+		CssText:     cssText,
+		Stats:       visitor.getStats(),
+		nestedViews: visitor.nestedViews,
+		classNames:  visitor.classNames,
+		registerKey: registerKey,
+		opts:        opts,
+	}, nil
+}
+
+func (g *typeScriptGenerator) emitImport(buffer *bytes.Buffer, viewNames []string, from string) {
+	classNames := make([]string, len(viewNames))
+	for i, viewName := range viewNames {
+		classNames[i] = g.className(viewName)
+	}
+	buffer.WriteString("\nimport { ")
+	buffer.WriteString(strings.Join(classNames, ", "))
+	buffer.WriteString(" } from '")
+	buffer.WriteString(from)
+	buffer.WriteString("';")
+}
+
+func (*typeScriptGenerator) commentLine(text string) string {
+	return "// " + text
+}
+
+func (g *typeScriptGenerator) emitRegistry(buffer *bytes.Buffer, viewNames []string) {
+	buffer.WriteString("\nexport const ")
+	buffer.WriteString(g.registryName())
+	buffer.WriteString(" = {")
+	for _, viewName := range viewNames {
+		buffer.WriteString("\n  '")
+		buffer.WriteString(viewTag(viewName))
+		buffer.WriteString("': ")
+		buffer.WriteString(g.className(viewName))
+		buffer.WriteString(",")
+	}
+	buffer.WriteString("\n};\n")
+}
+
+func (g *typeScriptGenerator) emitViewNameEnum(buffer *bytes.Buffer, viewNames []string) {
+	buffer.WriteString("\nexport enum ")
+	buffer.WriteString(g.viewNameEnum())
+	buffer.WriteString(" {")
+	var written []string
+	for _, viewName := range viewNames {
+		if contains(written, viewName) {
+			continue // Views in different folders can share a name.
+		}
+		written = append(written, viewName)
+		buffer.WriteString("\n  ")
+		buffer.WriteString(viewName)
+		buffer.WriteString(" = '")
+		buffer.WriteString(viewName)
+		buffer.WriteString("',")
+	}
+	buffer.WriteString("\n}\n")
+}
+
+func (g *typeScriptGenerator) emitHotModuleReplacement(buffer *bytes.Buffer, moduleId string) {
+	buffer.WriteString("\n")
+	buffer.WriteString(g.commentLine("hmr module id: " + moduleId))
+	buffer.WriteString("\n")
+	buffer.WriteString(g.hotAccept())
+	buffer.WriteString("\n")
+}
+
+// DF going down the stack.
+func (v *typeScriptVisitor) head(node *html.Node, depth int) error {
+	if v.ignoreSubtree {
+		// Like the children of a nested tomato. Their refs would never be set.
+		if node.Type == html.ElementNode && hasAttr(node, v.specialAttr(FieldRefAttr)) && len(v.inlineChain) == 0 {
+			return v.warn(node, "ref "+getAttr(node, v.specialAttr(FieldRefAttr))+" is never set, the element isn't built")
+		}
+		return nil
+	}
+
+	switch node.Type {
+	case html.ElementNode:
+		tagName := strings.ToLower(node.Data)
+		expr := &stringBuilder{}
+
+		if tagName == v.includeTag() && hasAttr(node, "src") {
+			if err := checkTomatoSrc(v.currentFile(), getAttr(node, "src"), v.GeneratorOptions); err != nil {
+				return err
+			}
+		}
+
+		if depth > 0 && tagName == v.includeTag() && v.InlineThreshold > 0 {
+			if inlined, err := v.inlineTomato(node, depth); err != nil || inlined {
+				return err
+			}
+		}
+
+		v.stats.Elements++
+		if depth > v.stats.MaxDepth {
+			v.stats.MaxDepth = depth
+		}
+
+		if depth == 0 {
+			v.root = node
+
+			// A ref on the root captures the root element itself.
+			v.refNames = templateRefNames(node, v.GeneratorOptions)
+			if v.rootRef = getAttr(node, v.specialAttr(FieldRefAttr)); v.rootRef != "" {
+				v.refs.PushBack(v.rootRef + ": HTMLElement")
+				v.hydration.append("\n    ").append(v.refTarget(v.rootRef)).append(" = ").append(v.rootRefValue("<HTMLElement>root")).append(";")
+			}
+
+			v.acceptsClass = hasAttrKey(node, v.specialAttr(AcceptsClassAttr))
+			if hasAttrKey(node, v.specialAttr(PropsAttr)) {
+				if v.ConstructorStyle != ConstructorOptions {
+					return fmt.Errorf("%s declares %s, which needs the options ConstructorStyle", v.fileName, v.specialAttr(PropsAttr))
+				} else if v.AsyncBuild {
+					return fmt.Errorf("%s declares %s, which the constructor can't hand to an AsyncBuild", v.fileName, v.specialAttr(PropsAttr))
+				}
+				v.props = parseProps(getAttr(node, v.specialAttr(PropsAttr)))
+			}
+
+			// Include debug IDs if we force them to.
+			if v.forceDebugIds && !hasAttr(node, v.debugIdAttr()) {
+				if allowed, err := v.addedAttrAllowed(node, v.debugIdAttr()); err != nil {
+					return err
+				} else if allowed {
+					emitAttr(expr, "", v.debugIdAttr(), debugIdFromViewName(v.viewName))
+					v.addDebugRef(debugIdFromViewName(v.viewName), v.rootRef)
+				}
+			} else {
+				v.addDebugRef(getAttr(node, v.debugIdAttr()), v.rootRef)
+			}
+
+			// Tag the root with the name of its view for devtools.
+			if v.TagRoot && !hasAttr(node, v.tagRootAttr()) {
+				if allowed, err := v.addedAttrAllowed(node, v.tagRootAttr()); err != nil {
+					return err
+				} else if allowed {
+					emitAttr(expr, "", v.tagRootAttr(), v.viewName)
+				}
+			}
+		} else {
+
+			// Is this element one that we need to elevate to a field reference?
+			fieldName := getAttr(node, v.specialAttr(FieldRefAttr))
+			hasFieldName := (fieldName != "") && len(v.inlineChain) == 0 // Inlined templates don't contribute refs.
+			refTarget := v.refTarget(fieldName)
+
+			// Lazy elements are built by their ref's getter, which keeps them in a backing field.
+			lazy := hasAttrKey(node, v.specialAttr(LazyAttr)) && len(v.inlineChain) == 0
+			if lazy {
+				if !hasFieldName {
+					return fmt.Errorf("%s: %s: %s elements need a %s to build them through", v.fileName, describeElement(v.root, node), v.specialAttr(LazyAttr), v.specialAttr(FieldRefAttr))
+				} else if v.RefStyle == RefMap {
+					return fmt.Errorf("%s: %s: %s requires field refs", v.fileName, describeElement(v.root, node), v.specialAttr(LazyAttr))
+				}
+				if v.CloneStrategy {
+					return fmt.Errorf("%s: %s: %s elements can't be cloned", v.fileName, describeElement(v.root, node), v.specialAttr(LazyAttr))
+				} else if v.AsyncBuild {
+					return fmt.Errorf("%s: %s: %s elements can't be built asynchronously", v.fileName, describeElement(v.root, node), v.specialAttr(LazyAttr))
+				}
+				refTarget = "this._" + fieldName
+			}
+
+			// Plain elements can be kept under an element ref, alongside or instead of their view ref.
+			viewRef := hasFieldName
+			if hasFieldName && !lazy && tagName != v.includeTag() && v.ElementRefs != ViewRefs {
+				v.elementRef = fieldName + v.elementRefSuffix()
+				viewRef = v.ElementRefs == ViewAndElementRefs
+				if contains(v.refNames, v.elementRef) {
+					return fmt.Errorf("%s: %s: the element ref of %s would be %s, which is already a ref", v.fileName, describeElement(v.root, node), fieldName, v.elementRef)
+				}
+			}
+			if viewRef && !lazy {
+				expr.append(refTarget).append(" = ")
+			}
+			if viewRef {
+				v.addDebugRef(getAttr(node, v.debugIdAttr()), fieldName)
+			} else if v.elementRef != "" {
+				v.addDebugRef(getAttr(node, v.debugIdAttr()), v.elementRef)
+			}
+			refType := v.ViewBaseClass
+
+			// Construct raw elements differently from nested tomato templates
+			if tagName == v.includeTag() {
+				v.ignoreSubtree = true // Nested tomatos can't have children.
+
+				src := getAttr(node, "src")
+				if src == "" {
+					return errors.New("Tomato element with no 'src' attribute!")
+				}
+				// Named from the resolved path, same as when the nested template itself is generated.
+				nestedName := v.GeneratorOptions.viewName(resolveSrc(v.currentFile(), src))
+				v.stats.NestedTomatos++
+				if !contains(v.nestedViews, nestedName) {
+					v.nestedViews = append(v.nestedViews, nestedName)
+				}
+				viewName, class := v.className(nestedName), v.className(nestedName)
+				if v.ScaffoldDir != "" {
+					// Built as the developer's subclass, which its stub hands to the Base class.
+					viewName, class = nestedName, class+".subclass"
+				}
+				args := "doc"
+				t, err := v.templates.load(resolveSrc(v.currentFile(), src))
+				if err != nil {
+					return err
+				}
+				if hasAttr(node, "class") && t.root != nil && hasAttrKey(t.root, v.specialAttr(AcceptsClassAttr)) {
+					args += ", " + v.classValueExpr(getAttr(node, "class"))
+					v.passedClass = node
+				}
+				if t.root != nil && hasAttrKey(t.root, v.specialAttr(PropsAttr)) && v.ConstructorStyle == ConstructorOptions {
+					var passed []string
+					for _, prop := range parseProps(getAttr(t.root, v.specialAttr(PropsAttr))) {
+						attr, ok := propAttr(node, prop)
+						if !ok {
+							if !prop.optional {
+								return fmt.Errorf("%s: %s: %s requires the prop %s", v.fileName, describeElement(v.root, node), viewName, prop.name)
+							}
+							continue
+						}
+						valueExpr, err := v.propValueExpr(node, prop, attr.Val)
+						if err != nil {
+							return err
+						}
+						passed = append(passed, "'"+escapeText(prop.name)+"': "+valueExpr)
+					}
+					args = "{" + strings.Join(passed, ", ") + "}, " + args
+					v.passedProps = node
+				}
+				expr.append("<").append(viewName).append(">new ").append(class).append("(").append(args).append(")")
+				refType = viewName
+				if v.LinkParents {
+					expr.append(".").append(v.setParentMethod()).append("(this)")
+				}
+				hydrated := "(<" + viewName + ">Object.create(" + class + ".prototype)).hydrate(" + elementPath(v.root, node) + ")"
+				if v.LinkParents {
+					hydrated += "." + v.setParentMethod() + "(this)"
+				}
+				if hasFieldName {
+					v.hydration.append("\n    ").append(v.childExpr(refTarget + " = " + hydrated)).append(";")
+				} else if v.CloneStrategy && len(v.inlineChain) == 0 {
+					// Copies of the nested view still need their own refs and listeners wired.
+					v.hydration.append("\n    ").append(hydrated).append(";")
+				}
+			} else {
+				if v.tagFactory(node) == "" {
+					expr.append(v.ViewFactory).append("('").append(tagName).append("', doc)")
+				} // Otherwise the factory call is emitted by transferAttrs, since it's passed the attributes.
+				if viewRef {
+					v.hydration.append("\n    ").append(refTarget).append(" = new ").append(v.ViewBaseClass).
+						append("(").append(elementPath(v.root, node)).append(");")
+				}
+				if v.elementRef != "" {
+					v.hydration.append("\n    ").append(v.refTarget(v.elementRef)).append(" = ").append(elementPath(v.root, node)).append(";")
+				}
+			}
+
+			if lazy {
+				split := &buildSplit{node: node, method: v.buildMethodName(node), lazyRef: fieldName, refType: refType}
+				for _, enclosing := range v.splits {
+					if enclosing.lazyRef != "" {
+						split.enclosingLazyRef = enclosing.lazyRef
+					}
+				}
+				v.splits = append(v.splits, split)
+				v.lazyRefs = append(v.lazyRefs, v.splits[len(v.splits)-1])
+			} else if hasFieldName {
+				// Refs inside a lazy subtree don't exist until it's built.
+				optional := ""
+				if v.lazyDepth() > 0 || v.AsyncBuild {
+					optional = "?"
+				}
+				if viewRef {
+					v.refs.PushBack(fieldName + optional + ": " + refType)
+				}
+				if v.elementRef != "" {
+					v.refs.PushBack(v.elementRef + optional + ": HTMLElement")
+				}
+			}
+		}
+
+		if v.MaxWrapperDepth > 0 && (depth == 0 || !isWrapper(node.Parent)) {
+			if chain := wrapperChainLength(node); chain > v.MaxWrapperDepth {
+				problem := fmt.Sprintf("%s nests %d wrapper elements, more than the maximum of %d", v.viewName, chain, v.MaxWrapperDepth)
+				if err := v.warn(node, problem); err != nil {
+					return err
+				}
+			}
+		}
+
+		if v.LintAria {
+			for _, problem := range lintAria(node) {
+				if err := v.warn(node, problem); err != nil {
+					return err
+				}
+			}
+		}
+
+		if v.EmitClassNames || v.EmitCssTypes {
+			_, classList, _ := parseConditionalAttr(getAttr(node, "class"))
+			for _, class := range strings.Fields(classList) {
+				if !contains(v.classNames, class) {
+					v.classNames = append(v.classNames, class)
+				}
+			}
+		}
+
+		// For all elements, we transfer any attributes set in the template
+		if err := v.transferAttrs(node, expr); err != nil {
+			return err
+		}
+		if listeners, err := v.listenerCalls(node); err != nil {
+			return err
+		} else if listeners != "" {
+			expr.append(listeners)
+			if v.CloneStrategy && len(v.inlineChain) > 0 {
+				return fmt.Errorf("%s: %s: listeners in inlined templates can't be cloned", v.fileName, describeElement(v.root, node))
+			} else if v.emitsHydrate() && len(v.inlineChain) == 0 {
+				v.hydration.append("\n    new ").append(v.ViewBaseClass).append("(").append(elementPath(v.root, node)).append(")").append(listeners).append(";")
+			}
+		}
+
+		if v.TrackChildren && depth > 0 && tagName == v.includeTag() && hasAttr(node, v.specialAttr(FieldRefAttr)) && len(v.inlineChain) == 0 {
+			wrapped := v.childExpr(expr.buffer.String())
+			expr.buffer.Reset()
+			expr.append(wrapped)
+		}
+
+		if v.SplitConstruction && depth == 1 && tagName != v.includeTag() && countElementChildren(node) > 0 && v.splitAt(node) == nil {
+			v.splits = append(v.splits, &buildSplit{node: node, method: v.buildMethodName(node), refType: v.ViewBaseClass})
+		}
+
+		// On a line of its own ahead of the element, since in the chain style whatever follows the element
+		// can end up on the same line.
+		commentIndent := indent(depth + len(v.fragmentParents))
+		if v.StatementStyle {
+			commentIndent = indent(0)
+		}
+		if line, ok := v.lines[node]; ok && v.LineComments {
+			v.domConstruction.append(commentIndent).append(v.generator.commentLine(line))
+		}
+		if v.MockTodos && hasAttrKey(node, v.specialAttr(MockAttr)) {
+			v.domConstruction.append(commentIndent).append(v.generator.commentLine("TODO: mock content for <" + tagName + ">"))
+		}
+
+		if v.StatementStyle {
+			v.emitElementStatements(node, depth, tagName, expr.buffer.String())
+		} else {
+			v.emitElementChain(node, depth, tagName, expr.buffer.String())
+		}
+
+		// Large groups of children get built up in a fragment which is then appended in one go.
+		if v.FragmentThreshold > 0 && tagName != v.includeTag() && countElementChildren(node) >= v.FragmentThreshold {
+			v.fragmentParents = append(v.fragmentParents, node)
+			if v.StatementStyle {
+				v.varCount++
+				name := fmt.Sprintf("f%d", v.varCount)
+				v.domConstruction.append(indent(0)).append("const ").append(name).append(" = ").append(v.fragmentFactory()).append("(doc);")
+				v.varStack.PushBack(name)
+			} else {
+				v.domConstruction.append(indent(depth + len(v.fragmentParents))).append(".append(").append(v.fragmentFactory()).append("(doc)")
+			}
+		}
+
+	case html.TextNode:
+		// Text split up by comments is appended as the one run, from its first node.
+		if !startsTextRun(node) {
+			return nil
+		}
+		text, last := textRun(node)
+
+		// Skip trailing whitespace nodes, but keep nodes with NBSP, and the spaces separating inline
+		// elements (<b>a</b> <i>b</i>), which the browser renders.
+		if "" != strings.TrimFunc(text, isCollapsibleSpace) || separatesInlineElements(node, last) {
+			if v.StatementStyle {
+				v.domConstruction.append(indent(0)).append(v.varStack.Back().Value.(string))
+			}
+			if v.RootTextSetter != "" && node.Parent == v.root && node.PrevSibling == nil && last.NextSibling == nil {
+				text := strings.TrimFunc(collapseWhitespace(text), isCollapsibleSpace)
+				v.domConstruction.append(".").append(v.RootTextSetter).append("('").append(escapeText(text)).append("')")
+			} else {
+				v.domConstruction.append(".appendText('").append(escapeText(collapseWhitespace(text))).append("')")
+			}
+			if v.StatementStyle {
+				v.domConstruction.append(";")
+			}
+		}
+	}
+
+	return nil // no error
+}
+
+// Registers a nested view's construction with the view building it, when TrackChildren is set.
+func (v *typeScriptVisitor) childExpr(construction string) string {
+	if !v.TrackChildren {
+		return construction
+	}
+	return "this." + v.addChildMethod() + "(" + construction + ")"
+}
+
+// Records an element's debug-id and ref for the debugRefs map, when it has both.
+func (v *visitorData) addDebugRef(debugId, ref string) {
+	if debugId != "" && ref != "" {
+		v.debugRefs = append(v.debugRefs, [2]string{debugId, ref})
+	}
+}
+
+// The template currently being walked, which is the inlined one while inlining.
+func (v *visitorData) currentFile() string {
+	if len(v.inlineChain) > 0 {
+		return v.inlineChain[len(v.inlineChain)-1]
+	}
+	return v.fileName
+}
+
+// Splices the construction of a small nested tomato straight into this view, rather than instantiating
+// its view. Tomatos with a _ref are left alone since the ref is typed as the nested view, and refs inside
+// the inlined template are dropped. Attributes on the tomato element carry over to the inlined root.
+func (v *typeScriptVisitor) inlineTomato(node *html.Node, depth int) (bool, error) {
+	src := getAttr(node, "src")
+	if src == "" || hasAttr(node, v.specialAttr(FieldRefAttr)) {
+		return false, nil
+	}
+
+	fileName := resolveSrc(v.currentFile(), src)
+	if fileName == v.fileName || contains(v.inlineChain, fileName) {
+		return false, nil // Recursive, leave it to the nested view.
+	}
+
+	t, err := v.templates.load(fileName)
+	if err != nil {
+		return false, err
+	}
+	if t.root == nil || t.root.Type != html.ElementNode || countElements(t.root) > v.InlineThreshold {
+		return false, nil
+	}
+
+	// Templates are shared, so the root is copied rather than having the tomato's attributes added to it.
+	root := *t.root
+	root.Attr = append([]html.Attribute{}, t.root.Attr...)
+	for _, attr := range node.Attr {
+		if attr.Key != "src" {
+			root.Attr = append(root.Attr, attr)
+		}
+	}
+
+	if len(v.inlineChain) >= v.maxIncludeDepth() {
+		chain := append(append([]string{v.fileName}, v.inlineChain...), fileName)
+		return false, fmt.Errorf("Nested tomatos are included more than %d deep: %s", v.maxIncludeDepth(), strings.Join(chain, " -> "))
+	}
+
+	v.stats.NestedTomatos++
+	v.inlineChain = append(v.inlineChain, fileName)
+	err = traverse(&root, depth, v)
+	v.inlineChain = v.inlineChain[:len(v.inlineChain)-1]
+
+	// Skip whatever the tomato element itself might contain, like for referenced tomatos.
+	v.ignoreSubtree = true
+	v.inlinedTomatoes = append(v.inlinedTomatoes, node)
+	return true, err
+}
+
+// The root element handed to super.
+func (v *typeScriptVisitor) rootElementExpr(tagName string) string {
+	create := "doc.createElement('" + tagName + "')"
+	if !v.CloneStrategy {
+		return create
+	}
+	return v.hasTemplateExpr() + " ? <HTMLElement>" + v.templateField() + ".cloneNode(true) : " + create
+}
+
+// Under the CloneStrategy, the static field holding the view's template and whether it can be cloned.
+func (v *typeScriptVisitor) templateField() string {
+	return v.className(v.viewName) + ".template"
+}
+
+func (v *typeScriptVisitor) hasTemplateExpr() string {
+	return v.templateField() + " && " + v.templateField() + ".ownerDocument === doc"
+}
+
+func (v *typeScriptVisitor) injectsCss() bool {
+	return v.InjectCss != CssFile && strings.TrimSpace(v.cssText) != ""
+}
+
+// Injects the view's Css, when no instance of the view has yet.
+func (v *typeScriptVisitor) emitCssInjection() {
+	className := v.className(v.viewName)
+	css := quoteLiteral(strings.TrimSpace(v.cssText), singleQuoted)
+	if v.InjectCss == CssInjectAdopted {
+		v.domConstruction.append(indent(0)).append("if (!").append(className).append(".styleSheet) {")
+		v.domConstruction.append(indent(1)).append(className).append(".styleSheet = new CSSStyleSheet();")
+		v.domConstruction.append(indent(1)).append(className).append(".styleSheet.replaceSync(").append(css).append(");")
+		v.domConstruction.append(indent(1)).append("doc.adoptedStyleSheets = [...doc.adoptedStyleSheets, ").append(className).append(".styleSheet];")
+	} else {
+		v.domConstruction.append(indent(0)).append("if (!").append(className).append(".cssInjected) {")
+		v.domConstruction.append(indent(1)).append("const style = doc.createElement('style');")
+		v.domConstruction.append(indent(1)).append("style.textContent = ").append(css).append(";")
+		v.domConstruction.append(indent(1)).append("doc.head.appendChild(style);")
+		v.domConstruction.append(indent(1)).append(className).append(".cssInjected = true;")
+	}
+	v.domConstruction.append(indent(0)).append("}")
+}
+
+func (v *typeScriptVisitor) emitsHydrate() bool {
+	return v.Hydrate || v.CloneStrategy
+}
+
+// What goes right after the call to super, before any of the root's attributes and children.
+func (v *typeScriptVisitor) emitAfterSuper() {
+	if v.injectsCss() {
+		v.emitCssInjection()
+	}
+	if v.rootRef != "" {
+		v.domConstruction.append(indent(0)).append(v.refTarget(v.rootRef)).append(" = ").append(v.rootRefValue("this.elem()")).append(";")
+	}
+	v.emitSnippet(&v.domConstruction, v.ConstructorPrologue)
+	v.constructionStart = v.domConstruction.buffer.Len()
+}
+
+// Emits a constructor snippet a line at a time, indented to match the constructor body.
+func (v *typeScriptVisitor) emitSnippet(builder *stringBuilder, snippet string) {
+	snippet = strings.Replace(snippet, "{{view}}", v.viewName, -1)
+	for _, line := range strings.Split(strings.TrimRight(snippet, "\n"), "\n") {
+		if line != "" {
+			builder.append(indent(0)).append(line)
+		}
+	}
+}
+
+// The root ref holds the root element, except in a refs map where everything is a view and the view
+// itself stands in for its root.
+func (v *typeScriptVisitor) rootRefValue(element string) string {
+	if v.RefStyle == RefMap {
+		return "this"
+	}
+	return element
+}
+
+// Emits an element as part of the single expression chain hanging off of the super call.
+func (v *typeScriptVisitor) emitElementChain(node *html.Node, depth int, tagName, expr string) {
+	v.domConstruction.append(indent(depth + len(v.fragmentParents)))
+	if depth == 0 {
+		// This is the first part of the view (call to super constructor).
+		v.domConstruction.append("super(").append(v.rootElementExpr(tagName)).append(");")
+		v.emitAfterSuper()
+		v.domConstruction.append("\n").append(indent(depth)).append("this")
+	} else {
+		// A sub-element. Lets start a call to append.
+		v.appendStack.PushBack(node)
+		v.domConstruction.append(".append(")
+		if split := v.splitAt(node); split != nil {
+			v.domConstruction.append(split.placeholder())
+			split.start = v.domConstruction.buffer.Len()
+			v.domConstruction.append(indent(0)).append("return ")
+		}
+	}
+	v.domConstruction.append(expr)
+}
+
+// Emits an element as a local variable declaration followed by its append to the parent element.
+func (v *typeScriptVisitor) emitElementStatements(node *html.Node, depth int, tagName, expr string) {
+	name := "this"
+	if depth == 0 {
+		v.domConstruction.append(indent(0)).append("super(").append(v.rootElementExpr(tagName)).append(");")
+		v.emitAfterSuper()
+		v.domConstruction.append("\n")
+		if expr != "" {
+			v.domConstruction.append(indent(0)).append(name).append(expr).append(";")
+		}
+	} else {
+		v.appendStack.PushBack(node)
+		v.varCount++
+		name = fmt.Sprintf("e%d", v.varCount)
+		if split := v.splitAt(node); split != nil {
+			v.emitAppend(split.placeholder())
+			split.start = v.domConstruction.buffer.Len()
+			v.domConstruction.append(indent(0)).append("const ").append(name).append(" = ").append(expr).append(";")
+			v.emitElementRef(name)
+		} else {
+			v.domConstruction.append(indent(0)).append("const ").append(name).append(" = ").append(expr).append(";")
+			v.emitElementRef(name)
+			v.emitAppend(name)
+		}
+	}
+	v.varStack.PushBack(name)
+
+	for _, attr := range v.conditionalAttrs {
+		v.domConstruction.append(indent(0)).append("if (").append(attr.condition).append(") ").append(name).append(attr.setter).append(";")
+	}
+	v.conditionalAttrs = nil
+}
+
+// Emits the append of child to the element being built, checked by the append guard when there is one.
+// Guarded children other than variables are held in one first, so that they're only evaluated once.
+func (v *typeScriptVisitor) emitAppend(child string) {
+	if v.AppendGuards {
+		if !isIdentifier(child) {
+			v.varCount++
+			name := fmt.Sprintf("a%d", v.varCount)
+			v.domConstruction.append(indent(0)).append("const ").append(name).append(" = ").append(child).append(";")
+			child = name
+		}
+		v.domConstruction.append(indent(0)).append("if (").append(v.devGuard()).append(") ").
+			append(v.appendGuardFunction()).append("(").append(child).append(");")
+	}
+	v.domConstruction.append(indent(0)).append(v.varStack.Back().Value.(string)).append(".append(").append(child).append(");")
+}
+
+// Captures the element of the view just declared under its element ref, if it has one.
+func (v *typeScriptVisitor) emitElementRef(name string) {
+	if v.elementRef != "" {
+		v.domConstruction.append(indent(0)).append(v.refTarget(v.elementRef)).append(" = <HTMLElement>").append(name).append(".elem();")
+		v.elementRef = ""
+	}
+}
+
+// DF popping back up the stack.
+func (v *typeScriptVisitor) tail(node *html.Node, depth int) {
+	if last := len(v.inlinedTomatoes) - 1; last >= 0 && v.inlinedTomatoes[last] == node {
+		v.inlinedTomatoes = v.inlinedTomatoes[:last]
+		v.ignoreSubtree = false
+		return
+	}
+
+	if last := len(v.fragmentParents) - 1; last >= 0 && v.fragmentParents[last] == node {
+		v.fragmentParents = v.fragmentParents[:last]
+		if v.StatementStyle {
+			v.emitAppend(v.varStack.Remove(v.varStack.Back()).(string))
+		} else {
+			v.domConstruction.append(")")
+		}
+	}
+
+	if v.appendStack.Len() > 0 && v.appendStack.Back().Value.(*html.Node) == node {
+		v.appendStack.Remove(v.appendStack.Back())
+		if v.StatementStyle {
+			name := v.varStack.Remove(v.varStack.Back()).(string)
+			if v.splitAt(node) != nil {
+				v.endBuildMethod(indent(0) + "return " + name + ";")
+			}
+		} else {
+			if v.splitAt(node) != nil {
+				v.endBuildMethod(";")
+			}
+			v.domConstruction.append(")")
+		}
+		v.ignoreSubtree = false
+	}
+}
+
+// Build methods are named after the ref of the element they build, when it has one.
+func (v *typeScriptVisitor) buildMethodName(node *html.Node) string {
+	if ref := []rune(getAttr(node, v.specialAttr(FieldRefAttr))); isIdentifier(string(ref)) {
+		return "build" + strings.ToUpper(string(ref[:1])) + string(ref[1:])
+	}
+	v.splitCount++
+	return fmt.Sprintf("build%d", v.splitCount)
+}
+
+// The innermost split, if it's the one for node.
+func (v *typeScriptVisitor) splitAt(node *html.Node) *buildSplit {
+	if last := len(v.splits) - 1; last >= 0 && v.splits[last].node == node {
+		return v.splits[last]
+	}
+	return nil
+}
+
+// How many lazy elements the current element is built inside of.
+func (v *typeScriptVisitor) lazyDepth() int {
+	depth := 0
+	for _, split := range v.splits {
+		if split.lazyRef != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// Moves everything emitted for the innermost split since it started out of the constructor (or the
+// enclosing build method) and into its own build method. Lazy elements also get the getter building
+// them on first access, in place of the comment that stands in for them until then.
+func (v *typeScriptVisitor) endBuildMethod(end string) {
+	split := v.splits[len(v.splits)-1]
+	v.splits = v.splits[:len(v.splits)-1]
+
+	body := string(v.domConstruction.buffer.Bytes()[split.start:])
+	v.domConstruction.buffer.Truncate(split.start)
+
+	if split.lazyRef != "" {
+		field, anchor := "this._"+split.lazyRef, "this._"+split.lazyRef+"Anchor"
+		v.buildMethods.append("\n\n  get ").append(split.lazyRef).append("(): ").append(split.refType).append(" {")
+		v.buildMethods.append("\n    if (!").append(field).append(") {")
+		if split.enclosingLazyRef != "" {
+			// The anchor only exists once the enclosing lazy element has been built.
+			v.buildMethods.append("\n      this.").append(split.enclosingLazyRef).append(";")
+		}
+		v.buildMethods.append("\n      ").append(field).append(" = this.").append(split.method).append("(<Document>this.elem().ownerDocument);")
+		v.buildMethods.append("\n      (<Node>").append(anchor).append(".parentNode).replaceChild(").append(field).append(".elem(), ").append(anchor).append(");")
+		v.buildMethods.append("\n    }")
+		v.buildMethods.append("\n    return ").append(field).append(";\n  }")
+	}
+
+	v.buildMethods.append("\n\n  private ").append(split.method).append("(doc: Document): ").append(split.refType).append(" {")
+	v.buildMethods.append(body).append(end).append("\n  }")
+}
+
+func (v *typeScriptVisitor) getView() string {
+	return v.output.buffer.String()
+}
+
+func (v *typeScriptVisitor) setCss(cssText string) {
+	v.cssText = cssText
+}
+
+func (v *typeScriptVisitor) getCss() string {
+	return v.cssText
+}
+
+func (v *typeScriptVisitor) getStats() ViewStats {
+	stats := v.stats
+	stats.Refs = v.refs.Len() + len(v.lazyRefs)
+	return stats
+}
+
+func (v *typeScriptVisitor) emitPreamble() {
+	// The handlers are declared through an interface merged into the class, so the class can call them
+	// while leaving their implementation to subclasses.
+	if len(v.handlers) > 0 {
+		className := v.className(v.viewName)
+		v.output.append("\nexport interface ").append(className).append("Handlers {")
+		for _, handler := range v.handlers {
+			v.output.append("\n  ").append(handler.method).append("(e: ").append(handler.eventType).append("): void;")
+		}
+		v.output.append("\n}\n")
+		v.output.append("\nexport interface ").append(className).append(" extends ").append(className).append("Handlers {}\n")
+	}
+
+	if len(v.props) > 0 {
+		v.output.append("\nexport interface ").append(v.className(v.viewName)).append("Options {")
+		for _, prop := range v.props {
+			v.output.append("\n  ").append(prop.decl).append(";")
+		}
+		v.output.append("\n}\n")
+	}
+
+	if v.EmitRefsInterface {
+		v.output.append("\nexport interface ").append(v.viewName).append("Refs {")
+		for e := v.refs.Front(); e != nil; e = e.Next() {
+			v.output.append("\n  ").append(e.Value.(string)).append(";")
+		}
+		for _, split := range v.lazyRefs {
+			v.output.append("\n  readonly ").append(split.lazyRef).append(": ").append(split.refType).append(";")
+		}
+		v.output.append("\n}\n")
+	}
+
+	if v.PrettierIgnore {
+		v.output.append("\n// prettier-ignore")
+	}
+	v.classStart = v.output.buffer.Len()
+	v.output.append("\nexport class ").append(v.className(v.viewName)).append(" extends ").append(v.ViewBaseClass)
+	if v.EmitRefsInterface && v.RefStyle == RefFields {
+		v.output.append(" implements ").append(v.viewName).append("Refs")
+	}
+	v.output.append(" {")
+	v.refsStart = v.output.buffer.Len()
+}
+
+func (v *typeScriptVisitor) emitElementRefs() {
+	if v.ScaffoldDir != "" {
+		className := v.className(v.viewName)
+		v.output.append("\n  static subclass: typeof ").append(className).append(" = ").append(className).append(";\n")
+	}
+	if v.CloneStrategy {
+		v.output.append("\n  private static template?: HTMLElement;\n")
+	}
+	if v.injectsCss() {
+		if v.InjectCss == CssInjectAdopted {
+			v.output.append("\n  private static styleSheet?: CSSStyleSheet;\n")
+		} else {
+			v.output.append("\n  private static cssInjected?: boolean;\n")
+		}
+	}
+
+	if v.EmitDebugRefs {
+		v.output.append("\n  static readonly debugRefs: { [debugId: string]: string } = {")
+		for i, pair := range v.debugRefs {
+			if i > 0 {
+				v.output.append(", ")
+			}
+			v.output.append("'").append(escapeText(pair[0])).append("': '").append(escapeText(pair[1])).append("'")
+		}
+		v.output.append("};\n")
+	}
+
+	if v.EmitClassNames {
+		v.output.append("\n  static readonly classes = {")
+		for i, class := range v.classNames {
+			if i > 0 {
+				v.output.append(", ")
+			}
+			v.output.append("'").append(escapeText(class)).append("': ").append(v.classValueExpr(class))
+		}
+		v.output.append("};\n")
+	}
+
+	if v.RefStyle == RefMap {
+		// Nested view types are lost here, everything in the map is just a base view.
+		v.output.append("\n  refs: { [name: string]: ").append(v.ViewBaseClass).append(" } = {};\n")
+		return
+	}
+
+	var guarded [][2]string // Names and types of the refs behind guarded accessors.
+	for e := v.refs.Front(); e != nil; e = e.Next() {
+		fieldDecl := e.Value.(string)
+		if parts := strings.SplitN(fieldDecl, "?: ", 2); len(parts) == 2 && v.DevRefGuards {
+			guarded = append(guarded, [2]string{parts[0], parts[1]})
+			fieldDecl = "private _" + fieldDecl
+		}
+		v.output.append("\n  ").append(fieldDecl).append(";")
+		if e == v.refs.Back() && len(v.lazyRefs) == 0 {
+			v.output.append("\n")
+		}
+	}
+
+	// Lazy refs are getters, backed by these until they're built.
+	for i, split := range v.lazyRefs {
+		v.output.append("\n  private _").append(split.lazyRef).append("?: ").append(split.refType).append(";")
+		v.output.append("\n  private _").append(split.lazyRef).append("Anchor: Comment;")
+		if i == len(v.lazyRefs)-1 {
+			v.output.append("\n")
+		}
+	}
+
+	for _, ref := range guarded {
+		name, refType := ref[0], ref[1]
+		v.output.append("\n  get ").append(name).append("(): ").append(refType).append(" | undefined {")
+		v.output.append("\n    if (").append(v.devGuard()).append(" && this._").append(name).append(" === undefined) {")
+		v.output.append("\n      console.warn('").append(v.className(v.viewName)).append(".").append(name).append(" was read before it was built');")
+		v.output.append("\n    }")
+		v.output.append("\n    return this._").append(name).append(";")
+		v.output.append("\n  }")
+		v.output.append("\n  set ").append(name).append("(").append(name).append(": ").append(refType).append(" | undefined) {")
+		v.output.append("\n    this._").append(name).append(" = ").append(name).append(";")
+		v.output.append("\n  }\n")
+	}
+}
+
+func (v *typeScriptVisitor) emitDomConstruction() {
+	v.methodsStart = v.output.buffer.Len()
+	v.output.append("\n  constructor(")
+	if len(v.props) > 0 {
+		v.output.append("opts: ").append(v.className(v.viewName)).append("Options, ")
+	}
+	v.output.append("doc: Document = document")
+	if v.acceptsClass {
+		v.output.append(", className: string = ''")
+	}
+	v.output.append(") {")
+	construction := v.domConstruction.buffer.String()
+	if v.StatementStyle {
+		construction = strings.TrimRight(construction, "\n")
+	} else if bare := strings.TrimSuffix(construction, "\n"+indent(0)+"this"); bare != construction {
+		// Nothing was chained onto the root, drop the otherwise bare `this;` statement.
+		construction = bare
+	} else {
+		construction += ";"
+	}
+	if v.ConstructorGuard {
+		construction = v.guardConstruction(construction)
+	}
+	if v.CloneStrategy {
+		construction = v.cloneOrBuild(construction)
+	}
+	var build string
+	if v.AsyncBuild {
+		if v.constructionStart > len(construction) {
+			v.constructionStart = len(construction) // The bare `this` was dropped.
+		}
+		construction, build = construction[:v.constructionStart], construction[v.constructionStart:]
+	}
+	v.output.append(construction)
+	if v.acceptsClass {
+		// Added last, so it merges with rather than being replaced by the template's own class.
+		v.output.append("\n    if (className) this.addClass(...className.trim().split(/\\s+/));")
+	}
+	v.emitSnippet(&v.output, v.ConstructorEpilogue)
+	v.output.append("\n  }")
+	if v.AsyncBuild {
+		v.output.append("\n\n  async ").append(v.asyncBuildMethod()).append("(): Promise<this> {")
+		v.output.append("\n    await new Promise((resolve) => requestAnimationFrame(resolve));")
+		v.output.append("\n    const doc = this.elem().ownerDocument || document;")
+		v.output.append(build)
+		v.output.append("\n    return this;\n  }")
+	}
+	v.output.append(v.buildMethods.buffer.String())
+}
+
+// Wraps the construction of the root's attributes and children in a try block that cleans up after a
+// construction that throws.
+func (v *typeScriptVisitor) guardConstruction(construction string) string {
+	if v.constructionStart > len(construction) {
+		v.constructionStart = len(construction)
+	}
+	if strings.TrimSpace(construction[v.constructionStart:]) == "" {
+		return construction // Nothing to guard.
+	}
+	guarded := &stringBuilder{}
+	guarded.append(construction[:v.constructionStart])
+	guarded.append(indent(0)).append("try {")
+	for _, line := range strings.Split(construction[v.constructionStart:], "\n") {
+		if strings.TrimSpace(line) != "" {
+			guarded.append("\n  ").append(line)
+		}
+	}
+	guarded.append(indent(0)).append("} catch (e) {")
+	guarded.append(indent(1)).append("this.").append(v.cleanupMethod()).append("();")
+	guarded.append(indent(1)).append("throw e;")
+	guarded.append(indent(0)).append("}")
+	return guarded.buffer.String()
+}
+
+// Wraps the construction of the root's attributes and children, so that it's only run when there's no
+// template to clone yet, and the copy of the template is hydrated instead.
+func (v *typeScriptVisitor) cloneOrBuild(construction string) string {
+	if v.constructionStart > len(construction) {
+		v.constructionStart = len(construction) // The bare `this` was dropped.
+	}
+	build := &stringBuilder{}
+	build.append(construction[:v.constructionStart])
+	build.append(indent(0)).append("if (").append(v.hasTemplateExpr()).append(") {")
+	build.append(indent(1)).append("this.hydrate(this.elem());")
+	build.append(indent(0)).append("} else {")
+	for _, line := range strings.Split(construction[v.constructionStart:], "\n") {
+		if strings.TrimSpace(line) != "" {
+			build.append("\n  ").append(line)
+		}
+	}
+	build.append(indent(1)).append(v.templateField()).append(" = <HTMLElement>this.elem().cloneNode(true);")
+	build.append(indent(0)).append("}")
+	return build.buffer.String()
+}
+
+// Nested views are hydrated without running their constructors (which would build a fresh tree), so
+// the hydrate method has to tolerate being the only initialization the instance ever gets.
+func (v *typeScriptVisitor) emitHydration() {
+	if !v.emitsHydrate() {
+		return
+	}
+	v.output.append("\n\n  hydrate(root: Element): this {")
+	v.output.append("\n    this.set(<HTMLElement>root);")
+	if v.RefStyle == RefMap {
+		v.output.append("\n    this.refs = {};")
+	}
+	v.output.append(v.hydration.buffer.String())
+	v.output.append("\n    return this;\n  }")
+}
+
+func (v *typeScriptVisitor) emitPostamble() {
+	v.classEnd = v.output.buffer.Len()
+	v.output.append("\n}\n")
+}
+
+// Writes the generated class out through the ClassTemplate.
+func (v *typeScriptVisitor) executeClassTemplate(viewText string) (string, error) {
+	tmpl, err := texttemplate.New("class").Parse(v.ClassTemplate)
+	if err != nil {
+		return "", fmt.Errorf("ClassTemplate: %s", err.Error())
+	}
+	parts := ClassParts{
+		Name:         v.className(v.viewName),
+		BaseClass:    v.ViewBaseClass,
+		Declarations: viewText[:v.classStart],
+		Refs:         viewText[v.refsStart:v.methodsStart],
+		Construction: viewText[v.methodsStart:v.classEnd],
+	}
+	if v.EmitRefsInterface && v.RefStyle == RefFields {
+		parts.Implements = v.viewName + "Refs"
+	}
+	text := &bytes.Buffer{}
+	if err := tmpl.Execute(text, parts); err != nil {
+		return "", fmt.Errorf("%s: ClassTemplate: %s", v.fileName, err.Error())
+	}
+	return text.String(), nil
+}
+
+// The expression a ref gets assigned to.
+func (v *typeScriptVisitor) refTarget(fieldName string) string {
+	if v.RefStyle == RefMap {
+		return "this.refs['" + escapeText(fieldName) + "']"
+	}
+	return "this." + fieldName
+}
+
+func (v *typeScriptVisitor) transferAttrs(node *html.Node, builder *stringBuilder) error {
+	var bulk []string
+	factory := v.tagFactory(node)
+	setters := builder
+	if factory != "" {
+		setters = &stringBuilder{} // Follow the factory call, which can only be written once the attributes are known.
+	}
+	for _, attr := range v.orderedAttrs(node) {
+
+		// Skip _ref, _ignoreContent and src on a tomato
+		if v.isBlockedAttr(attr.Key) || (strings.ToLower(node.Data) == v.includeTag() && attr.Key == "src") {
+			continue
+		}
+		if strings.HasPrefix(attr.Key, v.specialAttr(EventAttrPrefix)) {
+			continue // Listeners are added by listenerCalls.
+		}
+		if node == v.passedClass && attr.Key == "class" && attr.Namespace == "" {
+			continue // Handed to the nested view's constructor instead.
+		}
+		if node == v.passedProps && attr.Namespace == "" && v.isPassedProp(node, attr.Key) {
+			continue
+		}
+
+		// Transform _id to id in the generated view.
+		key := attr.Key
+		if v.specialAttr(TunnelledIdAttr) == attr.Key {
+			key = IdAttr
+		} else if rawPrefix := v.specialAttr(RawAttrPrefix); strings.HasPrefix(key, rawPrefix) {
+			key = key[len(rawPrefix):] // The value was already protected from decoding by preserveRawAttrs.
+		}
+
+		if !v.attrAllowed(key) {
+			if err := v.warn(node, "attribute "+key+" isn't allowed, dropping it"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		condition, val, conditional := parseConditionalAttr(attr.Val)
+		bare := v.BareAttrsAsBooleans && attr.Namespace == "" && v.isBareAttr(node, attr.Key)
+		if val == "" && !conditional && v.SkipEmptyAttrs && attr.Namespace == "" && !v.isBooleanAttr(key) && !bare {
+			continue
+		}
+		if v.AssetBaseURL != "" && contains(v.assetAttrs(), key) {
+			var err error
+			if val, err = v.assetURL(node, val); err != nil {
+				return err
+			}
+		}
+
+		valueExpr := "''" // Present, which is all a boolean attribute's value says.
+		if !bare {
+			var err error
+			if valueExpr, err = v.attrValueExpr(node, attr.Namespace, key, val); err != nil {
+				return err
+			} else if valueExpr == "" {
+				continue
+			}
+		}
+
+		if conditional {
+			if !v.StatementStyle {
+				return fmt.Errorf("Conditional attribute '%s' in %s requires StatementStyle", attr.Key, v.viewName)
+			} else if v.CloneStrategy {
+				return fmt.Errorf("Conditional attribute '%s' in %s can't be cloned", attr.Key, v.viewName)
+			}
+			setter := &stringBuilder{}
+			if dataKey := datasetKey(key); v.DatasetMethod != "" && attr.Namespace == "" && dataKey != "" {
+				setter.append(".").append(v.DatasetMethod).append("('").append(dataKey).append("', ").append(valueExpr).append(")")
+			} else {
+				if attr.Namespace != "" {
+					key = attr.Namespace + ":" + key
+				}
+				emitAttrExpr(setter, key, valueExpr)
+			}
+			v.conditionalAttrs = append(v.conditionalAttrs, conditionalAttr{condition, setter.buffer.String()})
+			continue
+		}
+
+		if key == "style" && attr.Namespace == "" && v.SplitStyles {
+			for _, decl := range parseStyle(val) {
+				setters.append(".").append(v.styleMethod()).append("('").append(escapeText(decl.property)).
+					append("', '").append(escapeText(decl.value)).append("'")
+				if decl.important {
+					setters.append(", 'important'")
+				}
+				setters.append(")")
+			}
+			continue
+		}
+
+		if dataKey := datasetKey(key); v.DatasetMethod != "" && attr.Namespace == "" && dataKey != "" {
+			setters.append(".").append(v.DatasetMethod).append("('").append(dataKey).append("', ").append(valueExpr).append(")")
+			continue
+		}
+
+		// Namespaced attributes can't be bulk set, they fall back to their own setAttr.
+		if (v.BulkAttrs || factory != "") && attr.Namespace == "" {
+			bulk = append(bulk, "'"+escapeText(key)+"': "+valueExpr)
+			continue
+		}
+
+		if attr.Namespace != "" {
+			key = attr.Namespace + ":" + key
+		}
+		emitAttrExpr(setters, key, valueExpr)
+	}
+
+	if factory != "" {
+		builder.append(factory).append("({").append(strings.Join(bulk, ", ")).append("}, doc)").append(setters.buffer.String())
+	} else if len(bulk) > 0 {
+		builder.append(".").append(v.bulkAttrsMethod()).append("({").append(strings.Join(bulk, ", ")).append("})")
+	}
+	return nil
+}
+
+// Whether the attribute was written without a value, in the template being walked.
+func (v *typeScriptVisitor) isBareAttr(node *html.Node, key string) bool {
+	bare := v.bareAttrs
+	if len(v.inlineChain) > 0 {
+		if t, err := v.templates.load(v.currentFile()); err == nil {
+			bare = t.bareAttrs
+		}
+	}
+	return bare.has(node, key)
+}
+
+func (v *typeScriptVisitor) isBooleanAttr(key string) bool {
+	key = strings.ToLower(key)
+	return v.AttrTypes[key] == AttrBoolean || DefaultAttrTypes[key] == AttrBoolean
+}
+
+// The element's attributes, sorted by name when SortAttrs.
+func (v *typeScriptVisitor) orderedAttrs(node *html.Node) []html.Attribute {
+	if !v.SortAttrs {
+		return node.Attr
+	}
+	attrs := append([]html.Attribute(nil), node.Attr...)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		if attrs[i].Namespace != attrs[j].Namespace {
+			return attrs[i].Namespace < attrs[j].Namespace
+		}
+		return attrs[i].Key < attrs[j].Key
+	})
+	return attrs
+}
+
+// The function creating the element, if its tag has one. The root is always created by the call to super.
+func (v *typeScriptVisitor) tagFactory(node *html.Node) string {
+	if node == v.root {
+		return ""
+	}
+	return v.TagFactories[strings.ToLower(node.Data)]
+}
+
+// The calls adding the element's event listeners, which forward the events to the view's handler methods.
+func (v *typeScriptVisitor) listenerCalls(node *html.Node) (string, error) {
+	calls := &stringBuilder{}
+	eventPrefix := v.specialAttr(EventAttrPrefix)
+	for _, attr := range node.Attr {
+		if !strings.HasPrefix(attr.Key, eventPrefix) {
+			continue
+		}
+		event, method := attr.Key[len(eventPrefix):], strings.TrimSpace(attr.Val)
+		if !isIdentifier(method) {
+			return "", fmt.Errorf("%s: %s: %s handler '%s' is not a method name", v.fileName, describeElement(v.root, node), attr.Key, attr.Val)
+		}
+
+		eventType := eventTypeOf(event)
+		if i := indexOfHandler(v.handlers, method); i < 0 {
+			v.handlers = append(v.handlers, eventHandler{method, eventType})
+		} else if v.handlers[i].eventType != eventType {
+			v.handlers[i].eventType = "Event" // Handling different kinds of events.
+		}
+		calls.append(".on('").append(escapeText(event)).append("', (e) => this.").append(method).append("(<").append(eventType).append(">e))")
+	}
+	return calls.buffer.String(), nil
+}
+
+// The expression for an attribute's value. Classes may be mapped through the CSS module, and attributes
+// with a type in AttrTypes are checked against it. Empty when the attribute is to be left out.
+func (v *typeScriptVisitor) attrValueExpr(node *html.Node, namespace, key, val string) (string, error) {
+	quoted := "'" + escapeText(val) + "'"
+	if namespace != "" {
+		return quoted, nil
+	} else if key == "class" {
+		return v.classValueExpr(val), nil
+	}
+
+	if enum := v.AttrEnums[strings.ToLower(key)]; enum != "" {
+		if member := enumMember(val); member != "" {
+			return enum + "." + member, nil
+		}
+		return quoted, v.warn(node, fmt.Sprintf("%s=\"%s\" can't be a member of %s", key, val, enum))
+	}
+
+	switch v.AttrTypes[strings.ToLower(key)] {
+	case AttrNumber:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+			return "'" + strings.TrimSpace(val) + "'", nil
+		}
+		return quoted, v.warn(node, fmt.Sprintf("%s=\"%s\" is not a number", key, val))
+	case AttrBoolean:
+		// Boolean attributes are true by being there, whatever their value, short of an explicit "false".
+		if strings.EqualFold(strings.TrimSpace(val), "false") {
+			return "", nil
+		}
+		return "''", nil
+	}
+	return quoted, nil
+}
+
+// The PascalCase enum member for an attribute value, or nothing when the value can't be one.
+func enumMember(val string) string {
+	member := &strings.Builder{}
+	for _, word := range strings.FieldsFunc(val, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		runes := []rune(word)
+		member.WriteRune(unicode.ToUpper(runes[0]))
+		member.WriteString(string(runes[1:]))
+	}
+	if member.Len() == 0 || unicode.IsDigit([]rune(member.String())[0]) {
+		return ""
+	}
+	return member.String()
+}
+
+// Rewrites a relative asset URL to where the asset is served. Anything else (absolute URLs, other
+// schemes, fragments) is left as is.
+func (v *typeScriptVisitor) assetURL(node *html.Node, val string) (string, error) {
+	u, err := url.Parse(val)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return val, nil
+	}
+
+	root, err := filepath.Abs(v.AssetRoot)
+	if err != nil {
+		return val, err
+	}
+	asset, err := filepath.Abs(filepath.Join(filepath.Dir(v.currentFile()), filepath.FromSlash(u.Path)))
+	if err != nil {
+		return val, err
+	}
+	rel, err := filepath.Rel(root, asset)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return val, v.warn(node, "asset "+val+" is outside of the asset root")
+	}
+
+	u.Path = ""
+	return strings.TrimSuffix(v.AssetBaseURL, "/") + "/" + filepath.ToSlash(rel) + u.String(), nil
+}
+
+// The expression for a class attribute's value.
+func (v *typeScriptVisitor) classValueExpr(classList string) string {
+	if v.ClassModule != "" {
+		return classModuleExpr(v.classModuleName(), classList)
+	}
+	return "'" + escapeText(classList) + "'"
+}
+
+////////////////////////
+// private functions
+////////////////////////
+func generateView(v viewGenerator) string {
+	v.emitPreamble()
+	v.emitElementRefs()
+	v.emitDomConstruction()
+	v.emitHydration()
+	v.emitPostamble()
+	return v.getView()
+}
+
+// Elements laid out inline, so that whitespace between them shows up as a space.
+var inlineElements = []string{
+	"a", "abbr", "b", "bdi", "bdo", "button", "cite", "code", "data", "dfn", "em", "i", "img", "input", "kbd",
+	"label", "mark", "q", "s", "samp", "select", "small", "span", "strong", "sub", "sup", "textarea", "time",
+	"u", "var",
+}
+
+// Whether a node is the first of a run of text nodes, which comments can split up.
+func startsTextRun(node *html.Node) bool {
+	prev := node.PrevSibling
+	for prev != nil && prev.Type == html.CommentNode {
+		prev = prev.PrevSibling
+	}
+	return prev == nil || prev.Type != html.TextNode
+}
+
+// The text of the run of text nodes starting at first, skipping the comments between them, and the
+// run's last node.
+func textRun(first *html.Node) (string, *html.Node) {
+	text, last := first.Data, first
+	for n := first.NextSibling; n != nil && (n.Type == html.TextNode || n.Type == html.CommentNode); n = n.NextSibling {
+		if n.Type == html.TextNode {
+			text += n.Data
+			last = n
+		}
+	}
+	return text, last
+}
+
+// Whether a whitespace run of text, from first to last, sits between two inline elements, ignoring any
+// comments.
+func separatesInlineElements(first, last *html.Node) bool {
+	prev, next := first.PrevSibling, last.NextSibling
+	for prev != nil && prev.Type == html.CommentNode {
+		prev = prev.PrevSibling
+	}
+	for next != nil && next.Type == html.CommentNode {
+		next = next.NextSibling
+	}
+	isInline := func(n *html.Node) bool {
+		return n != nil && n.Type == html.ElementNode && contains(inlineElements, strings.ToLower(n.Data))
+	}
+	return isInline(prev) && isInline(next)
+}
+
+func isCollapsibleSpace(r rune) bool {
+	if r == 0xA0 { // NBSP
+		return false
+	}
+	return unicode.IsSpace(r)
+}
+
+// Collapses each run of whitespace (newlines and tabs included) into a single space, the same way the
+// browser would render it. Deleting the newlines instead would glue together words wrapped in the source.
+func collapseWhitespace(text string) string {
+	collapsed := &strings.Builder{}
+	inSpace := false
+	for _, r := range text {
+		if isCollapsibleSpace(r) {
+			if !inSpace {
+				collapsed.WriteRune(' ')
+			}
+			inSpace = true
+			continue
+		}
+		collapsed.WriteRune(r)
+		inSpace = false
+	}
+	return collapsed.String()
+}
+
+// The kinds of string literal text can be written out as.
+type literalStyle int
+
+const (
+	singleQuoted    literalStyle = iota // 'text', the TypeScript generator's default.
+	doubleQuoted                        // "text"
+	templateLiteral                     // `text`, where ${ would start an interpolation.
+)
+
+// Escapes needed whatever the literal: backslashes, which would otherwise escape what follows them, and
+// the line breaks quoted literals can't hold.
+var commonEscapes = []string{"\\", "\\\\", "\n", "\\n", "\r", "\\r", "\u2028", "\\u2028", "\u2029", "\\u2029"}
+
+// The escaping of each literal style, on top of the common escapes.
+var literalEscapers = map[literalStyle]*strings.Replacer{
+	singleQuoted:    strings.NewReplacer(append([]string{"'", "\\'"}, commonEscapes...)...),
+	doubleQuoted:    strings.NewReplacer(append([]string{"\"", "\\\""}, commonEscapes...)...),
+	templateLiteral: strings.NewReplacer(append([]string{"`", "\\`", "${", "\\${"}, commonEscapes...)...),
+}
+
+// The delimiters of each literal style.
+var literalQuotes = map[literalStyle]string{
+	singleQuoted:    "'",
+	doubleQuoted:    "\"",
+	templateLiteral: "`",
+}
+
+// Escapes text for the inside of a string literal of the given style.
+func escapeLiteral(text string, style literalStyle) string {
+	return literalEscapers[style].Replace(text)
+}
+
+// Writes text out as a string literal of the given style.
+func quoteLiteral(text string, style literalStyle) string {
+	return literalQuotes[style] + escapeLiteral(text, style) + literalQuotes[style]
+}
+
+// Escapes text for the inside of a single quoted string literal, which is what the TypeScript is
+// generated with.
+func escapeText(text string) string {
+	return escapeLiteral(text, singleQuoted)
+}
+
+func emitAttr(builder *stringBuilder, namespace, key, val string) {
+	if namespace != "" {
+		key = namespace + ":" + key
+	}
+	emitAttrExpr(builder, key, "'"+escapeText(val)+"'")
+}
+
+// The dataset property of a data-* attribute, its name after data- with each dash and letter that
+// follows turned into the upper cased letter. Other attributes have none.
+func datasetKey(attr string) string {
+	if !strings.HasPrefix(attr, "data-") {
+		return ""
+	}
+	key := &strings.Builder{}
+	name := attr[len("data-"):]
+	for i := 0; i < len(name); i++ {
+		if name[i] == '-' && i+1 < len(name) && name[i+1] >= 'a' && name[i+1] <= 'z' {
+			key.WriteByte(name[i+1] - 'a' + 'A')
+			i++
+			continue
+		}
+		key.WriteByte(name[i])
+	}
+	if !isIdentifier(key.String()) {
+		return "" // Not a property the dataset can be indexed with as is.
+	}
+	return key.String()
+}
+
+func emitAttrExpr(builder *stringBuilder, key, expr string) {
+	builder.append(".setAttr('").append(key).append("', ").append(expr).append(")")
+}
+
+// Maps one of the underscore prefixed special attributes to the name it goes by with the configured
+// SpecialPrefix. Safe to call on nil options.
+func (opts *GeneratorOptions) specialAttr(attr string) string {
+	if opts == nil || opts.SpecialPrefix == "" || !strings.HasPrefix(attr, "_") {
+		return attr
+	}
+	return opts.SpecialPrefix + attr[1:]
+}
+
+func (opts *GeneratorOptions) isBlockedAttr(key string) bool {
+	for _, attr := range blockedAttrs {
+		if opts.specialAttr(attr) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an attribute passes the AllowedAttrs and DeniedAttrs policy.
+func (opts *GeneratorOptions) attrAllowed(key string) bool {
+	key = strings.ToLower(key)
+	if len(opts.AllowedAttrs) > 0 && !matchesAttrPattern(opts.AllowedAttrs, key) {
+		return false
+	}
+	return !matchesAttrPattern(opts.DeniedAttrs, key)
+}
+
+func matchesAttrPattern(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if pattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps a template's path to its view name.
+func (opts *GeneratorOptions) viewName(fileName string) string {
+	name := getViewName(fileName)
+	if opts.ViewNameFunc != nil {
+		name = opts.ViewNameFunc(fileName)
+	}
+	if opts.SanitizeViewNames {
+		return sanitizeIdentifier(name)
+	}
+	return name
+}
+
+// The name of the class generated for a view.
+func (opts *GeneratorOptions) className(viewName string) string {
+	if opts.ScaffoldDir != "" {
+		return viewName + "Base"
+	}
+	return viewName
+}
+
+func (opts *GeneratorOptions) viewSeparator() string {
+	if opts.ViewSeparator == nil {
+		return "\n\n"
+	}
+	return *opts.ViewSeparator
+}
+
+func (opts *GeneratorOptions) cssSeparator() string {
+	if opts.CssSeparator == nil {
+		return "\n\n"
+	}
+	return *opts.CssSeparator
+}
+
+func (opts *GeneratorOptions) fragmentFactory() string {
+	if opts.FragmentFactory == "" {
+		return "createFragment"
+	}
+	return opts.FragmentFactory
+}
+
+func (opts *GeneratorOptions) debugIdAttr() string {
+	if opts.DebugIdAttr == "" {
+		return DebugIdAttr
+	}
+	return opts.DebugIdAttr
+}
+
+func (opts *GeneratorOptions) assetAttrs() []string {
+	if opts.AssetAttrs == nil {
+		return []string{"src", "href"}
+	}
+	return opts.AssetAttrs
+}
+
+func (opts *GeneratorOptions) viewNameEnum() string {
+	if opts.ViewNameEnum == "" {
+		return "ViewName"
+	}
+	return opts.ViewNameEnum
+}
+
+func (opts *GeneratorOptions) registryName() string {
+	if opts.RegistryName == "" {
+		return "views"
+	}
+	return opts.RegistryName
+}
+
+// The distinct TagFactories functions, sorted, leaving out the ones already imported.
+func (opts *GeneratorOptions) tagFactoryNames() []string {
+	var names []string
+	for _, factory := range opts.TagFactories {
+		if factory != opts.ViewFactory && factory != opts.ViewBaseClass && !contains(names, factory) {
+			names = append(names, factory)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The options with the given options files merged over them in turn. Templates are parsed before their
+// options are known, so the options affecting parsing (SpecialPrefix, ParseContext, ...) can't be
+// overridden.
+func (opts *GeneratorOptions) withOverrides(optionsFiles []string) (*GeneratorOptions, error) {
+	if len(optionsFiles) == 0 {
+		return opts, nil
+	}
+	merged := *opts
+	for _, optionsFile := range optionsFiles {
+		data, err := ioutil.ReadFile(optionsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// Decoding reuses slices and maps, which are still shared with opts.
+		merged.AssetAttrs = append([]string(nil), merged.AssetAttrs...)
+		merged.AllowedAttrs = append([]string(nil), merged.AllowedAttrs...)
+		merged.DeniedAttrs = append([]string(nil), merged.DeniedAttrs...)
+		merged.EslintDisable = append([]string(nil), merged.EslintDisable...)
+		merged.AttrTypes = copyStringMap(merged.AttrTypes)
+		merged.TagFactories = copyStringMap(merged.TagFactories)
+		merged.AttrEnums = copyStringMap(merged.AttrEnums)
+
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return nil, fmt.Errorf("%s: %s", optionsFile, err.Error())
+		}
+	}
+	return &merged, nil
+}
+
+// The names the views use from the view library: the base class and factory, then any others.
+func (opts *GeneratorOptions) runtimeNames() []string {
+	names := []string{opts.ViewBaseClass, opts.ViewFactory}
+	if opts.FragmentThreshold > 0 {
+		names = append(names, opts.fragmentFactory())
+	}
+	if opts.AppendGuards {
+		names = append(names, opts.appendGuardFunction())
+	}
+	return append(names, opts.tagFactoryNames()...)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// The distinct AttrEnums enums, sorted.
+func (opts *GeneratorOptions) enumNames() []string {
+	var names []string
+	for _, enum := range opts.AttrEnums {
+		if !contains(names, enum) {
+			names = append(names, enum)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (opts *GeneratorOptions) registerImportLocation() string {
+	if opts.RegisterImportLocation == "" {
+		return opts.ImportLocation
+	}
+	return opts.RegisterImportLocation
+}
+
+func (opts *GeneratorOptions) enumsImportLocation() string {
+	if opts.EnumsImportLocation == "" {
+		return opts.ImportLocation
+	}
+	return opts.EnumsImportLocation
+}
+
+func (opts *GeneratorOptions) includeTag() string {
+	if opts.IncludeTag == "" {
+		return "tomato"
+	}
+	return strings.ToLower(opts.IncludeTag)
+}
+
+func (opts *GeneratorOptions) devGuard() string {
+	if opts.DevGuard == "" {
+		return "process.env.NODE_ENV !== 'production'"
+	}
+	return opts.DevGuard
+}
+
+func (opts *GeneratorOptions) hyperscriptFunction() string {
+	if opts.HyperscriptFunction == "" {
+		return "h"
+	}
+	return opts.HyperscriptFunction
+}
+
+func (opts *GeneratorOptions) cleanupMethod() string {
+	if opts.CleanupMethod == "" {
+		return "dispose"
+	}
+	return opts.CleanupMethod
+}
+
+func (opts *GeneratorOptions) appendGuardFunction() string {
+	if opts.AppendGuardFunction == "" {
+		return "assertDetached"
+	}
+	return opts.AppendGuardFunction
+}
+
+func (opts *GeneratorOptions) elementRefSuffix() string {
+	if opts.ElementRefSuffix == "" {
+		return "El"
+	}
+	return opts.ElementRefSuffix
+}
+
+func (opts *GeneratorOptions) setParentMethod() string {
+	if opts.SetParentMethod == "" {
+		return "setParent"
+	}
+	return opts.SetParentMethod
+}
+
+func (opts *GeneratorOptions) addChildMethod() string {
+	if opts.AddChildMethod == "" {
+		return "addChild"
+	}
+	return opts.AddChildMethod
+}
+
+func (opts *GeneratorOptions) asyncBuildMethod() string {
+	if opts.AsyncBuildMethod == "" {
+		return "buildAsync"
+	}
+	return opts.AsyncBuildMethod
+}
+
+func (opts *GeneratorOptions) maxIncludeDepth() int {
+	if opts.MaxIncludeDepth <= 0 {
+		return DefaultMaxIncludeDepth
+	}
+	return opts.MaxIncludeDepth
+}
+
+func (opts *GeneratorOptions) hotAccept() string {
+	if opts.HotAccept == "" {
+		return "if (import.meta.hot) {\n  import.meta.hot.accept();\n}"
+	}
+	return opts.HotAccept
+}
+
+func (opts *GeneratorOptions) tagRootAttr() string {
+	if opts.TagRootAttr == "" {
+		return "data-view"
+	}
+	return opts.TagRootAttr
+}
+
+func (opts *GeneratorOptions) parseContext() string {
+	if opts.ParseContext == "" {
+		return "body"
+	}
+	return opts.ParseContext
+}
+
+func (opts *GeneratorOptions) styleMethod() string {
+	if opts.StyleMethod == "" {
+		return "setCss"
+	}
+	return opts.StyleMethod
+}
+
+func (opts *GeneratorOptions) bulkAttrsMethod() string {
+	if opts.BulkAttrsMethod == "" {
+		return "setAttrs"
+	}
+	return opts.BulkAttrsMethod
+}
+
+func (opts *GeneratorOptions) classModuleName() string {
+	if opts.ClassModuleName == "" {
+		return "styles"
+	}
+	return opts.ClassModuleName
+}
+
+// Maps each class in a class list through the imported styles object, joining them back up with spaces.
+func classModuleExpr(styles, classList string) string {
+	classes := strings.Fields(classList)
+	if len(classes) == 0 {
+		return "''"
+	}
+
+	exprs := make([]string, len(classes))
+	for i, class := range classes {
+		if isIdentifier(class) {
+			exprs[i] = styles + "." + class
+		} else {
+			exprs[i] = styles + "['" + escapeText(class) + "']"
+		}
+	}
+	return strings.Join(exprs, " + ' ' + ")
+}
+
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Drops the characters that can't be in an identifier, upper casing the ones following them.
+func sanitizeIdentifier(s string) string {
+	builder := &strings.Builder{}
+	upper := false
+	for _, r := range s {
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			upper = builder.Len() > 0
+			continue
+		}
+		if builder.Len() == 0 && unicode.IsDigit(r) {
+			builder.WriteRune('_')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		builder.WriteRune(r)
+	}
+	if builder.Len() == 0 {
+		return "_"
+	}
+	return builder.String()
+}
+
+// Conditional attribute values look like {{?condition}}value. The attribute is set to value (usually
+// empty, for boolean attributes like disabled) only when the condition expression is truthy. Values
+// without a condition come back as they are.
+func parseConditionalAttr(val string) (string, string, bool) {
+	if !strings.HasPrefix(val, "{{?") {
+		return "", val, false
+	}
+	end := strings.Index(val, "}}")
+	if end < 0 {
+		return "", val, false
+	}
+	return strings.TrimSpace(val[len("{{?"):end]), val[end+len("}}"):], true
+}
+
+type styleDecl struct {
+	property  string
+	value     string
+	important bool
+}
+
+// Splits an inline style into its declarations. Semicolons and colons inside quotes or parentheses,
+// like in url(data:...;base64,...), don't count as separators, and escaped quotes don't end quotes.
+func parseStyle(style string) []styleDecl {
+	var decls []styleDecl
+	var quote rune
+	escaped := false
+	depth, start, colon := 0, 0, -1
+	for i, r := range style + ";" {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0:
+			if r == '\\' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case r == ':' && colon < 0:
+			colon = i
+		case r == ';':
+			if colon >= 0 {
+				decl := styleDecl{property: strings.TrimSpace(style[start:colon]), value: strings.TrimSpace(style[colon+1 : i])}
+				if end := strings.LastIndex(decl.value, "!"); end >= 0 && strings.EqualFold(strings.TrimSpace(decl.value[end+1:]), "important") {
+					decl.value, decl.important = strings.TrimSpace(decl.value[:end]), true
+				}
+				if decl.property != "" {
+					decls = append(decls, decl)
+				}
+			}
+			start, colon = i+1, -1
+		}
+	}
+	return decls
+}
+
+func contains(arr []string, val string) bool {
+	for _, item := range arr {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts the elements in the tree rooted at node, node included.
+func countElements(node *html.Node) int {
+	count := 0
+	if node.Type == html.ElementNode {
+		count++
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		count += countElements(c)
+	}
+	return count
+}
+
+func countElementChildren(node *html.Node) int {
+	count := 0
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			count++
+		}
+	}
+	return count
+}
+
+// An element whose only content is a single child element.
+func isWrapper(node *html.Node) bool {
+	if node.Type != html.ElementNode || countElementChildren(node) != 1 {
+		return false
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode && strings.TrimFunc(c.Data, isCollapsibleSpace) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// The number of wrappers nested one inside the next, starting at node.
+func wrapperChainLength(node *html.Node) int {
+	length := 0
+	for ; isWrapper(node); length++ {
+		for node = node.FirstChild; node.Type != html.ElementNode; node = node.NextSibling {
+		}
+	}
+	return length
+}
+
+func hasAttr(node *html.Node, attr string) bool {
+	return getAttr(node, attr) != ""
+}
+
+// Unlike hasAttr, true for attributes without a value as well.
+func hasAttrKey(node *html.Node, attr string) bool {
+	for _, item := range node.Attr {
+		if item.Key == attr {
+			return true
+		}
+	}
+	return false
+}
+
+func getAttr(node *html.Node, attr string) string {
+	for _, item := range node.Attr {
+		if item.Key == attr {
+			return item.Val
+		}
+	}
+	return ""
+}
+
+// A parsed template, ready to be walked by any number of visitors. Visitors must not modify the tree.
+type template struct {
+	fileName  string
+	root      *html.Node
+	css       string
+	overrides []string // Options files applying to the template, outermost first.
+	lines     sourceLines
+	bareAttrs bareAttrs
+}
+
+// Where in the template files elements come from, as file:line.
+type sourceLines map[*html.Node]string
+
+// The attributes of elements that were written without a value, which parsing gives the same empty
+// value as those written with one.
+type bareAttrs map[*html.Node][]string
+
+func (bare bareAttrs) has(node *html.Node, key string) bool {
+	return contains(bare[node], key)
+}
+
+// The file and line an element comes from, when they were recorded.
+func (lines sourceLines) position(node *html.Node) (string, int, bool) {
+	position, ok := lines[node]
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndex(position, ":")
+	line, err := strconv.Atoi(position[i+1:])
+	if i < 0 || err != nil {
+		return "", 0, false
+	}
+	return filepath.FromSlash(position[:i]), line, true
+}
+
+func loadTemplates(files *list.List, opts *GeneratorOptions) (*list.List, error) {
+	templates := list.New()
+	for e := files.Front(); e != nil; e = e.Next() {
+		t, err := loadTemplate(e.Value.(string), opts)
+		if err != nil {
+			return nil, err
+		}
+		templates.PushBack(t)
+	}
+	return templates, nil
+}
+
+func loadTemplate(fileName string, opts *GeneratorOptions) (*template, error) {
+	var lines sourceLines
+	if opts.LineComments || opts.Logger.keepsDiagnostics() {
+		lines = make(sourceLines)
+	}
+	var bare bareAttrs
+	if opts.BareAttrsAsBooleans {
+		bare = make(bareAttrs)
+	}
+
+	rootElem, css, err := parseTemplate(fileName, opts, lines, bare)
+	if err != nil {
+		return nil, err
+	}
+
+	rootElem, err = applyLayout(fileName, rootElem, opts, []string{fileName}, lines, bare)
+	if err != nil {
+		return nil, err
+	}
+	return &template{fileName: fileName, root: rootElem, css: css, lines: lines, bareAttrs: bare}, nil
+}
+
+// Parsed templates keyed by path, so that templates referenced from several places are parsed once.
+type templateCache struct {
+	opts      *GeneratorOptions
+	templates map[string]*template
+}
+
+func newTemplateCache(templates *list.List, opts *GeneratorOptions) *templateCache {
+	cache := &templateCache{opts, make(map[string]*template)}
+	for e := templates.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*template)
+		cache.templates[filepath.Clean(t.fileName)] = t
+	}
+	return cache
+}
+
+func (c *templateCache) load(fileName string) (*template, error) {
+	fileName = filepath.Clean(fileName)
+	if t, ok := c.templates[fileName]; ok {
+		return t, nil
+	}
+
+	t, err := loadTemplate(fileName, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	c.templates[fileName] = t
+	return t, nil
+}
+
+// Makes sure the nested tomatos a template builds, whether inlined or instantiated, don't go more than
+// MaxIncludeDepth deep, which recursive ones always would. Lazy tomatos aren't built along with their
+// view, so they're how views nest themselves. Missing templates are left to the walk to report.
+func (c *templateCache) checkNesting(fileName string) error {
+	deepest := make(map[string][]string) // The longest chain of nested templates under each template.
+	tooDeep := func(chain []string) error {
+		return fmt.Errorf("Nested tomatos are included more than %d deep: %s", c.opts.maxIncludeDepth(), strings.Join(chain, " -> "))
+	}
+
+	var visit func(chain []string) ([]string, error)
+	visit = func(chain []string) ([]string, error) {
+		fileName := chain[len(chain)-1]
+		if len(chain) > c.opts.maxIncludeDepth()+1 || contains(chain[:len(chain)-1], fileName) {
+			return nil, tooDeep(chain)
+		}
+		if nested, ok := deepest[fileName]; ok {
+			if len(chain)+len(nested)-2 > c.opts.maxIncludeDepth() {
+				return nil, tooDeep(append(chain[:len(chain)-1:len(chain)-1], nested...))
+			}
+			return nested, nil
+		}
+
+		t, err := c.load(fileName)
+		if err != nil {
+			return nil, err
+		}
+		longest := []string{fileName}
+		var srcs []string
+		if t.root != nil {
+			srcs = nestedTomatoSrcs(t.root, c.opts, false)
+		}
+		for _, src := range srcs {
+			nestedFile := filepath.Clean(resolveSrc(fileName, src))
+			if !templateExists(nestedFile, c.opts) {
+				continue
+			}
+			nested, err := visit(append(chain[:len(chain):len(chain)], nestedFile))
+			if err != nil {
+				return nil, err
+			}
+			if len(nested)+1 > len(longest) {
+				longest = append([]string{fileName}, nested...)
+			}
+		}
+		deepest[fileName] = longest
+		return longest, nil
+	}
+	_, err := visit([]string{filepath.Clean(fileName)})
+	return err
+}
+
+// The refs of the elements under n, those of nested tomatos included but not the elements they hold.
+func templateRefNames(n *html.Node, opts *GeneratorOptions) []string {
+	var names []string
+	if n.Type == html.ElementNode {
+		if ref := getAttr(n, opts.specialAttr(FieldRefAttr)); ref != "" {
+			names = append(names, ref)
+		}
+		if strings.ToLower(n.Data) == opts.includeTag() {
+			return names
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		names = append(names, templateRefNames(c, opts)...)
+	}
+	return names
+}
+
+// The srcs of the tomatos under n, leaving out the lazy ones that aren't built along with it unless
+// withLazy.
+func nestedTomatoSrcs(n *html.Node, opts *GeneratorOptions, withLazy bool) []string {
+	var srcs []string
+	if n.Type == html.ElementNode && strings.ToLower(n.Data) == opts.includeTag() {
+		if hasAttr(n, "src") && (withLazy || !hasAttrKey(n, opts.specialAttr(LazyAttr))) {
+			srcs = append(srcs, getAttr(n, "src"))
+		}
+		return srcs // Nested tomatos can't have children.
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		srcs = append(srcs, nestedTomatoSrcs(c, opts, withLazy)...)
+	}
+	return srcs
+}
+
+func walk(t *template, visitor viewGenerator) error {
+	visitor.setCss(t.css)
+	if t.root == nil {
+		return fmt.Errorf("Template cannot be empty: %s", t.fileName)
+	}
+	return traverse(t.root, 0, visitor)
+}
+
+// Depth First traversal. Call the visitor going down the stack, and popping back up.
+func traverse(n *html.Node, depth int, visitor viewGenerator) error {
+	if err := visitor.head(n, depth); err != nil {
+		return err
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if err := traverse(c, depth+1, visitor); err != nil {
+			return err
+		}
+	}
+
+	visitor.tail(n, depth)
+	return nil
+}
+
+// Reads and parses a template, returning its root element along with the Css slurped off of it.
+// The lines of the template's elements are recorded in lines, unless it's nil.
+func parseTemplate(fileName string, opts *GeneratorOptions, lines sourceLines, bare bareAttrs) (*html.Node, string, error) {
+	contentsBytes, err := readTemplate(fileName, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contents := string(contentsBytes)
+	if opts.IncludePattern != "" {
+		if contents, err = replaceIncludes(contents, opts.IncludePattern, opts.includeTag()); err != nil {
+			return nil, "", fmt.Errorf("%s: %s", fileName, err.Error())
+		}
+	}
+	if opts.StrictMarkup {
+		if err := opts.reportProblems(fileName, checkMarkup(blankStyleBodies(contents), opts)); err != nil {
+			return nil, "", err
+		}
+	}
+	if opts.ValidateCss {
+		if err := opts.reportProblems(fileName, checkCss(contents)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// slurp off the Css. Scoped blocks only apply within the view, so they're nested under a selector
+	// for its root, which gets tagged with the view's name.
+	contents, css, scopedCss, globalCss := extractStyles(contents)
+	scopeAttr := html.Attribute{Key: opts.tagRootAttr(), Val: opts.viewName(fileName)}
+	if opts.ScopeStrategy == ScopeAttribute {
+		scopeAttr = html.Attribute{Key: ScopeIdAttr, Val: scopeId(opts.viewName(fileName))}
+		if css += scopedCss; strings.TrimSpace(css) != "" {
+			css = scopeSelectors(css, "["+scopeAttr.Key+"=\""+scopeAttr.Val+"\"]")
+			scopedCss = css // The root gets tagged all the same.
+		}
+	} else if scopedCss != "" {
+		css += "\n[" + scopeAttr.Key + "=\"" + scopeAttr.Val + "\"] {" + scopedCss + "}\n"
+	}
+	css = globalCss + css // Ahead of the view's own rules, like the resets they usually are.
+
+	if rawPrefix := opts.specialAttr(RawAttrPrefix); strings.Contains(contents, rawPrefix) {
+		contents = preserveRawAttrs(contents, rawPrefix)
+	}
+
+	var rootElem *html.Node
+	if opts.DocumentParsing {
+		rootElem, err = parseDocumentRoot(contents)
+	} else {
+		rootElem, err = parseFragmentRoot(contents, opts)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if lines != nil && rootElem != nil {
+		// Matched up against the file as written, before the Css was taken out of it.
+		recordSourceLines(string(contentsBytes), rootElem.Parent, fileName, lines)
+	}
+	if bare != nil && rootElem != nil {
+		recordBareAttrs(string(contentsBytes), rootElem.Parent, bare)
+	}
+
+	// Text can't be a view's root, it needs an element around it.
+	if rootElem != nil && rootElem.Type == html.TextNode {
+		if opts.TextRootTag == "" {
+			return nil, "", fmt.Errorf("Template %s starts with text rather than a root element, wrap it in one or set a TextRootTag", fileName)
+		}
+		rootElem = wrapChildren(rootElem.Parent, opts.TextRootTag)
+	} else if roots := countRoots(rootElem); roots > 1 {
+		if opts.FragmentRootTag == "" {
+			return nil, "", fmt.Errorf("Template %s has %d root elements rather than one, wrap them in one or set a FragmentRootTag", fileName, roots)
+		}
+		rootElem = wrapChildren(rootElem.Parent, opts.FragmentRootTag)
+	}
+
+	if opts.DeprecateStripMe && rootElem != nil && hasAttrKey(rootElem, opts.specialAttr(StripMeAttr)) {
+		problem := Diagnostic{Message: opts.specialAttr(StripMeAttr) + " is deprecated, table parts can be roots without it so remove the wrapper"}
+		if _, line, ok := lines.position(rootElem); ok {
+			problem.Line = line
+		}
+		if err := opts.reportProblems(fileName, []Diagnostic{problem}); err != nil {
+			return nil, "", err
+		}
+	}
+	rootElem = strip(rootElem, opts)
+	if scopedCss != "" && rootElem != nil && !hasAttr(rootElem, scopeAttr.Key) {
+		rootElem.Attr = append(rootElem.Attr, scopeAttr)
+	}
+	return rootElem, css, nil
+}
+
+// Moves all of parent's children into a new element with the given tag, which takes their place.
+func wrapChildren(parent *html.Node, tag string) *html.Node {
+	wrapper := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	for c := parent.FirstChild; c != nil; c = parent.FirstChild {
+		parent.RemoveChild(c)
+		wrapper.AppendChild(c)
+	}
+	parent.AppendChild(wrapper)
+	return wrapper
+}
+
+// Counts the root element and the elements and text alongside it, none of which would be built.
+func countRoots(rootElem *html.Node) int {
+	if rootElem == nil {
+		return 0
+	}
+	roots := 1
+	for n := rootElem.NextSibling; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode || (n.Type == html.TextNode && strings.TrimFunc(n.Data, isCollapsibleSpace) != "") {
+			roots++
+		}
+	}
+	return roots
+}
+
+// Reads a template from the in memory sources when generating from them, otherwise from disk.
+func readTemplate(fileName string, opts *GeneratorOptions) ([]byte, error) {
+	if opts.sources != nil {
+		contents, ok := opts.sources[filepath.Clean(fileName)]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+		}
+		return []byte(contents), nil
+	}
+
+	// open input file
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// close fi on exit and check for its returned error
+	defer func() {
+		if err := fi.Close(); err != nil {
+			fmt.Println(err.Error())
+			// panic(err)
+		}
+	}()
+
+	r := bufio.NewReader(fi)
+	return ioutil.ReadAll(r)
+}
+
+func templateExists(fileName string, opts *GeneratorOptions) bool {
+	if opts.sources != nil {
+		_, ok := opts.sources[filepath.Clean(fileName)]
+		return ok
+	}
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// Swaps include comments for the tomato elements they stand for.
+func replaceIncludes(contents, pattern, tag string) (string, error) {
+	include, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	} else if include.NumSubexp() < 1 {
+		return "", fmt.Errorf("include pattern %s has no group for the included path", pattern)
+	}
+	return include.ReplaceAllStringFunc(contents, func(comment string) string {
+		src := include.FindStringSubmatch(comment)[1]
+		return "<" + tag + ` src="` + html.EscapeString(src) + `"></` + tag + ">"
+	}), nil
+}
+
+// Elements whose end tags can be left out.
+var optionalEndTags = []string{
+	"p", "li", "dt", "dd", "tr", "td", "th", "option", "optgroup", "thead", "tbody", "tfoot", "colgroup",
+	"caption", "rb", "rt", "rtc", "rp",
+}
+
+// Elements that never have content, so never have end tags.
+var voidElements = []string{
+	"area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "param", "source", "track", "wbr",
+}
+
+// Walks the template's tags looking for markup the parser would quietly reinterpret. The problems
+// found are left for the caller to give a file and severity.
+func checkMarkup(contents string, opts *GeneratorOptions) []Diagnostic {
+	type openTag struct {
+		name string
+		line int
+	}
+	var problems []Diagnostic
+	var open []openTag
+	foreign := 0 // Depth within svg or math, where tags aren't HTML's.
+	line := 1
+	z := html.NewTokenizer(strings.NewReader(contents))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		name, _ := z.TagName()
+		tag := string(name)
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if foreign == 0 && !isKnownTag(tag, opts) {
+				problems = append(problems, Diagnostic{Line: line, Message: fmt.Sprintf("unknown tag <%s>", tag)})
+			}
+			if tt == html.StartTagToken && !contains(voidElements, tag) {
+				open = append(open, openTag{tag, line})
+				if tag == "svg" || tag == "math" {
+					foreign++
+				}
+			}
+		case html.EndTagToken:
+			i := len(open) - 1
+			for i >= 0 && open[i].name != tag {
+				i--
+			}
+			if i < 0 {
+				problems = append(problems, Diagnostic{Line: line, Message: fmt.Sprintf("</%s> doesn't close any element", tag)})
+				break
+			}
+			for _, unclosed := range open[i+1:] {
+				if foreign > 0 || !contains(optionalEndTags, unclosed.name) {
+					problems = append(problems, Diagnostic{Line: line, Message: fmt.Sprintf("</%s> closes <%s> from line %d, which isn't closed", tag, unclosed.name, unclosed.line)})
+				}
+			}
+			if tag == "svg" || tag == "math" {
+				foreign--
+			}
+			open = open[:i]
+		}
+		line += strings.Count(string(z.Raw()), "\n")
+	}
+
+	for _, unclosed := range open {
+		if !contains(optionalEndTags, unclosed.name) {
+			problems = append(problems, Diagnostic{Line: unclosed.line, Message: fmt.Sprintf("<%s> is never closed", unclosed.name)})
 		}
 	}
-	return views, nil
+	return problems
 }
 
-func (*typeScriptGenerator) EmitPostamble(buffer *bytes.Buffer) {
+func isKnownTag(tag string, opts *GeneratorOptions) bool {
+	return atom.Lookup([]byte(tag)) != 0 || tag == opts.includeTag() || tag == LayoutContentTag || strings.Contains(tag, "-") ||
+		opts.TagFactories[tag] != "" || tag == opts.TextRootTag
 }
 
-func (g *typeScriptGenerator) generateView(fileName string, forceDebugIds bool) (string, string, error) {
-	visitor := typeScriptVisitor{visitorData{
-		GeneratorOptions: g.GeneratorOptions,
-		forceDebugIds: forceDebugIds,
-		viewName:      getViewName(fileName),
-	}}
+// A start tag of a template as written.
+type sourceTag struct {
+	name      string
+	line      int
+	bareAttrs []string // The attributes written without a value.
+}
 
-	if err := walk(fileName, &visitor); err != nil {
-		return "", "", err
+func scanStartTags(contents string) []sourceTag {
+	var tags []sourceTag
+	line := 1
+	z := html.NewTokenizer(strings.NewReader(contents))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			name, _ := z.TagName()
+			tags = append(tags, sourceTag{string(name), line, bareAttrNames(string(z.Raw()))})
+		}
+		line += strings.Count(string(z.Raw()), "\n")
 	}
-
-	// Generate the View and return it.
-	return generateView(&visitor), visitor.getCss(), nil
+	return tags
 }
 
-// DF going down the stack.
-func (v *typeScriptVisitor) head(node *html.Node, depth int) error {
-	if v.ignoreSubtree {
-		return nil
+// Parsing doesn't keep track of where elements come from, so the elements under parent are matched up
+// with the start tags of the template in order. Elements the parser implied (with no start tag of their
+// own) are skipped over.
+func matchStartTags(tags []sourceTag, parent *html.Node, match func(n *html.Node, tag sourceTag)) {
+	next := 0
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			for i := next; i < len(tags); i++ {
+				if tags[i].name == strings.ToLower(c.Data) {
+					match(c, tags[i])
+					next = i + 1
+					break
+				}
+			}
+			visit(c)
+		}
+	}
+	if parent != nil {
+		visit(parent)
 	}
+}
 
-	switch node.Type {
-	case html.ElementNode:
-		tagName := strings.ToLower(node.Data)
-		v.domConstruction.append(indent(depth))
+func recordSourceLines(contents string, parent *html.Node, fileName string, lines sourceLines) {
+	matchStartTags(scanStartTags(contents), parent, func(n *html.Node, tag sourceTag) {
+		lines[n] = filepath.ToSlash(fileName) + ":" + strconv.Itoa(tag.line)
+	})
+}
 
-		if depth == 0 {
+func recordBareAttrs(contents string, parent *html.Node, bare bareAttrs) {
+	matchStartTags(scanStartTags(contents), parent, func(n *html.Node, tag sourceTag) {
+		if len(tag.bareAttrs) > 0 {
+			bare[n] = tag.bareAttrs
+		}
+	})
+}
 
-			// This is the first part of the view (call to super constructor).
-			v.domConstruction.append("super(doc.createElement('").append(tagName).append("'));\n").append(indent(depth)).append("this")
+// The (lower cased) names of the attributes of a raw start tag that have no value.
+func bareAttrNames(tag string) []string {
+	var names []string
+	scanAttrs(tag, func(name string, valueStart, valueEnd int) {
+		if valueStart < 0 {
+			names = append(names, name)
+		}
+	})
+	return names
+}
 
-			// Include debug IDs if we force them to.
-			if v.forceDebugIds && !hasAttr(node, DebugIdAttr) {
-				emitAttr(&v.domConstruction, "", DebugIdAttr, debugIdFromViewName(v.viewName))
+// Walks the attributes of a raw start tag, handing visit each one's (lower cased) name along with where
+// its value starts and ends within the tag, without any quotes. Both are -1 for attributes without a
+// value.
+func scanAttrs(tag string, visit func(name string, valueStart, valueEnd int)) {
+	i := strings.IndexAny(tag, " \t\n\r\f/>") // Past the tag name.
+	for i >= 0 && i < len(tag) {
+		for i < len(tag) && strings.IndexByte(" \t\n\r\f/", tag[i]) >= 0 {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '>' {
+			break
+		}
+		end := i + 1
+		for end < len(tag) && strings.IndexByte(" \t\n\r\f/=>", tag[end]) < 0 {
+			end++
+		}
+		name := strings.ToLower(tag[i:end])
+		for end < len(tag) && strings.IndexByte(" \t\n\r\f", tag[end]) >= 0 {
+			end++
+		}
+		if end >= len(tag) || tag[end] != '=' {
+			visit(name, -1, -1)
+			i = end
+			continue
+		}
+
+		end++
+		for end < len(tag) && strings.IndexByte(" \t\n\r\f", tag[end]) >= 0 {
+			end++
+		}
+		if end < len(tag) && (tag[end] == '"' || tag[end] == '\'') {
+			valueStart, valueEnd := end+1, len(tag)
+			if closeQuote := strings.IndexByte(tag[valueStart:], tag[end]); closeQuote >= 0 {
+				valueEnd = valueStart + closeQuote
 			}
+			visit(name, valueStart, valueEnd)
+			end = valueEnd + 1
 		} else {
-
-			// A sub-element. Lets start a call to append.
-			v.appendStack.PushBack(node)
-			v.domConstruction.append(".append(")
-
-			// Is this element one that we need to elevate to a field reference?
-			fieldName := getAttr(node, FieldRefAttr)
-			hasFieldName := (fieldName != "")
-			if hasFieldName {
-				v.domConstruction.append("this.").append(fieldName).append(" = ")
+			valueStart := end
+			for end < len(tag) && strings.IndexByte(" \t\n\r\f>", tag[end]) < 0 {
+				end++
 			}
+			visit(name, valueStart, end)
+		}
+		i = end
+	}
+}
 
-			// Construct raw elements differently from nested tomato templates
-			if tagName == "tomato" {
-				v.ignoreSubtree = true // Nested tomatos can't have children.
+// Pulls the <style> blocks out of a template, returning what's left of it along with the Css of the
+// unmarked blocks, of the blocks marked scoped and of those marked global, which are never scoped.
+func extractStyles(contents string) (string, string, string, string) {
+	rest, css, scopedCss, globalCss := &strings.Builder{}, &strings.Builder{}, &strings.Builder{}, &strings.Builder{}
+	for {
+		start := indexStyleTag(contents)
+		if start < 0 {
+			break
+		}
+		openEnd := strings.Index(contents[start:], ">")
+		if openEnd < 0 {
+			break
+		}
+		closeStart := indexStyleClose(contents[start+openEnd+1:])
+		if closeStart < 0 {
+			break
+		}
+		closeStart += openEnd + 1
 
-				src := getAttr(node, "src")
-				if src == "" {
-					return errors.New("Tomato element with no 'src' attribute!")
-				}
-				viewName := getViewName(src)
-				v.domConstruction.append("<").append(viewName).append(">new ").append(viewName).append("(doc)")
-				if hasFieldName {
-					v.refs.PushBack(fieldName + ": " + viewName)
-				}
-			} else {
-				v.domConstruction.append(v.ViewFactory).append("('").append(tagName).append("', doc)")
-				if hasFieldName {
-					v.refs.PushBack(fieldName + ": " + v.ViewBaseClass)
-				}
+		z := html.NewTokenizer(strings.NewReader(contents[start : start+openEnd+1]))
+		z.Next()
+		target := css
+		for _, attr := range z.Token().Attr {
+			if attr.Key == "global" {
+				target = globalCss
+				break
+			} else if attr.Key == "scoped" {
+				target = scopedCss
 			}
 		}
+		target.WriteString(contents[start+openEnd+1 : start+closeStart])
 
-		// For all elements, we transfer any attributes set in the template
-		v.transferAttrs(node)
+		rest.WriteString(contents[:start])
+		contents = contents[start+closeStart+len("</style>"):]
+	}
+	rest.WriteString(contents)
+	return rest.String(), css.String(), scopedCss.String(), globalCss.String()
+}
 
-	case html.TextNode:
-		// Skip trailing whitespace nodes, but keep nodes with NBSP.
-		f := func(r rune) bool {
-			if r == 0xA0 { // NBSP
-				return false
-			}
-			return unicode.IsSpace(r)
+// Blanks out the Css of the template's style blocks, the way extractStyles finds them, keeping their line
+// breaks so that lines still count the same. Markup is then checked without a </style> in a Css string
+// reading as a stray closing tag.
+func blankStyleBodies(contents string) string {
+	blanked := []byte(contents)
+	offset := 0
+	for {
+		start := indexStyleTag(contents[offset:])
+		if start < 0 {
+			break
 		}
-		if "" != strings.TrimFunc(node.Data, f) {
-			v.domConstruction.append(".appendText('").append(escapeText(strings.Replace(node.Data, "\n", "", -1))).append("')")
+		start += offset
+		openEnd := strings.Index(contents[start:], ">")
+		if openEnd < 0 {
+			break
 		}
+		bodyStart := start + openEnd + 1
+		closeStart := indexStyleClose(contents[bodyStart:])
+		if closeStart < 0 {
+			break
+		}
+		for i := bodyStart; i < bodyStart+closeStart; i++ {
+			if blanked[i] != '\n' {
+				blanked[i] = ' '
+			}
+		}
+		offset = bodyStart + closeStart + len("</style>")
 	}
-
-	return nil // no error
+	return string(blanked)
 }
 
-// DF popping back up the stack.
-func (v *typeScriptVisitor) tail(node *html.Node, depth int) {
-	if v.appendStack.Len() > 0 && v.appendStack.Back().Value.(*html.Node) == node {
-		v.appendStack.Remove(v.appendStack.Back())
-		v.domConstruction.append(")")
-		v.ignoreSubtree = false
+// Checks the template's style blocks, the way extractStyles finds them, for the mistakes that leave a
+// broken stylesheet. It's no CSS parser, just enough to catch imbalances. Like checkMarkup, the problems
+// are left for the caller to give a file and severity.
+func checkCss(contents string) []Diagnostic {
+	var problems []Diagnostic
+	offset := 0
+	lineAt := func(i int) int {
+		return strings.Count(contents[:i], "\n") + 1
 	}
-}
-
-func (v *typeScriptVisitor) getView() string {
-	return v.output.buffer.String()
-}
-
-func (v *typeScriptVisitor) setCss(cssText string) {
-	v.cssText = cssText
-}
-
-func (v *typeScriptVisitor) getCss() string {
-	return v.cssText
-}
-
-func (v *typeScriptVisitor) emitPreamble() {
-	v.output.append("\nexport class ").append(v.viewName).append(" extends ").append(v.ViewBaseClass).append(" {")
-}
+	for {
+		start := indexStyleTag(contents[offset:])
+		if start < 0 {
+			break
+		}
+		start += offset
+		openEnd := strings.Index(contents[start:], ">")
+		closeStart := -1
+		if openEnd >= 0 {
+			closeStart = indexStyleClose(contents[start+openEnd+1:])
+		}
+		if closeStart < 0 {
+			problems = append(problems, Diagnostic{Line: lineAt(start), Message: "<style> is never closed"})
+			break
+		}
+		blockStart := start + openEnd + 1
+		blockEnd := blockStart + closeStart
 
-func (v *typeScriptVisitor) emitElementRefs() {
-	for e := v.refs.Front(); e != nil; e = e.Next() {
-		fieldDecl := e.Value.(string)
-		v.output.append("\n  ").append(fieldDecl).append(";")
-		if e == v.refs.Back() {
-			v.output.append("\n")
+		var braces []int // Where the open blocks start.
+		for i := blockStart; i < blockEnd; i++ {
+			switch c := contents[i]; c {
+			case '/':
+				if i+1 < blockEnd && contents[i+1] == '*' {
+					end := strings.Index(contents[i+2:blockEnd], "*/")
+					if end < 0 {
+						problems = append(problems, Diagnostic{Line: lineAt(i), Message: "comment is never closed"})
+						i = blockEnd
+					} else {
+						i += end + 3
+					}
+				}
+			case '"', '\'':
+				j := i + 1
+				for ; j < blockEnd && contents[j] != c && contents[j] != '\n'; j++ {
+					if contents[j] == '\\' {
+						j++ // Escapes, including escaped newlines, don't end the string.
+					}
+				}
+				if j >= blockEnd || contents[j] != c {
+					problems = append(problems, Diagnostic{Line: lineAt(i), Message: "string is never closed"})
+				}
+				i = j
+			case '{':
+				braces = append(braces, i)
+			case '}':
+				if len(braces) == 0 {
+					problems = append(problems, Diagnostic{Line: lineAt(i), Message: "} doesn't close any block"})
+				} else {
+					braces = braces[:len(braces)-1]
+				}
+			}
+		}
+		for _, brace := range braces {
+			problems = append(problems, Diagnostic{Line: lineAt(brace), Message: "{ is never closed"})
 		}
+		offset = blockEnd + len("</style>")
 	}
+	return problems
 }
 
-func (v *typeScriptVisitor) emitDomConstruction() {
-	v.output.append("\n  constructor(doc: Document = document) {")
-	v.output.append(v.domConstruction.buffer.String())
-	v.output.append(";\n  }")
+// A short id for the view, derived from its name so that it's the same from one run to the next.
+func scopeId(viewName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(viewName))
+	return fmt.Sprintf("%08x", h.Sum32())
 }
 
-func (v *typeScriptVisitor) emitPostamble() {
-	v.output.append("\n}\n")
-}
+// At-rules whose blocks hold rules, which get scoped like top level ones.
+var groupingAtRules = []string{"@media", "@supports", "@container", "@layer", "@document"}
 
-func (v *typeScriptVisitor) transferAttrs(node *html.Node) {
-	for _, attr := range node.Attr {
+// Scopes the selectors of the rules in css with the scope selector, so that they only apply to elements
+// matching it and their descendants. Comments and strings are skipped over, and rule bodies are copied
+// as is.
+func scopeSelectors(css, scope string) string {
+	out := &strings.Builder{}
+	i := 0
+	for i < len(css) {
+		// Whitespace and comments ahead of a rule are kept as they are.
+		start := i
+		for i < len(css) && (isCollapsibleSpace(rune(css[i])) || strings.HasPrefix(css[i:], "/*")) {
+			i = skipCssToken(css, i)
+		}
+		out.WriteString(css[start:i])
+		if i >= len(css) {
+			break
+		}
 
-		// Skip _ref, _ignoreContent and src on a tomato
-		if contains(blockedAttrs, attr.Key) || (strings.ToLower(node.Data) == "tomato" && attr.Key == "src") {
+		open := i
+		for open < len(css) && css[open] != '{' && css[open] != ';' && css[open] != '}' {
+			open = skipCssToken(css, open)
+		}
+		if open >= len(css) || css[open] != '{' {
+			// Statement at-rules like @import, along with anything stray.
+			end := open + 1
+			if end > len(css) {
+				end = len(css)
+			}
+			out.WriteString(css[i:end])
+			i = end
 			continue
 		}
-
-		// Transform _id to id in the generated view.
-		key := attr.Key
-		if TunnelledIdAttr == attr.Key {
-			key = IdAttr
+		close := closingBrace(css, open)
+		if close >= len(css) {
+			out.WriteString(css[i:]) // Unbalanced, see ValidateCss.
+			break
 		}
 
-		emitAttr(&v.domConstruction, attr.Namespace, key, attr.Val)
+		prelude, body := css[i:open], css[open+1:close]
+		if strings.HasPrefix(prelude, "@") {
+			name := strings.ToLower(strings.FieldsFunc(prelude, func(r rune) bool { return isCollapsibleSpace(r) || r == '(' })[0])
+			if contains(groupingAtRules, name) {
+				body = scopeSelectors(body, scope)
+			}
+			out.WriteString(prelude)
+		} else {
+			var selectors []string
+			for _, selector := range splitSelectors(prelude) {
+				selectors = append(selectors, scopeCompound(selector, scope), scope+" "+selector)
+			}
+			out.WriteString(strings.Join(selectors, ", "))
+			out.WriteString(" ")
+		}
+		out.WriteString("{")
+		out.WriteString(body)
+		out.WriteString("}")
+		i = close + 1
 	}
+	return out.String()
 }
 
-////////////////////////
-// private functions
-////////////////////////
-func generateView(v viewGenerator) string {
-	v.emitPreamble()
-	v.emitElementRefs()
-	v.emitDomConstruction()
-	v.emitPostamble()
-	return v.getView()
+// Adds the scope to the first compound of selector, after its type selector since that has to lead.
+func scopeCompound(selector, scope string) string {
+	i := 0
+	for i < len(selector) && (isCssNameChar(selector[i]) || selector[i] == '*' || selector[i] == '|') {
+		i++
+	}
+	return selector[:i] + scope + selector[i:]
 }
 
-func escapeText(text string) string {
-	return strings.Replace(text, "'", "\\'", -1)
+func isCssNameChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 0x80 || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
-func emitAttr(builder *stringBuilder, namespace, key, val string) {
-	if namespace != "" {
-		key = namespace + ":" + key
+// Splits a selector list on its top level commas, leaving those in parentheses, brackets and strings.
+func splitSelectors(prelude string) []string {
+	var selectors []string
+	depth, start := 0, 0
+	for i := 0; i < len(prelude); {
+		switch prelude[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				selectors = append(selectors, strings.TrimSpace(prelude[start:i]))
+				start = i + 1
+			}
+		}
+		i = skipCssToken(prelude, i)
 	}
-	builder.append(".setAttr('").append(key).append("', '").append(escapeText(val)).append("')")
-}
+	selectors = append(selectors, strings.TrimSpace(prelude[start:]))
 
-func contains(arr []string, val string) bool {
-	for _, item := range arr {
-		if item == val {
-			return true
+	nonEmpty := selectors[:0]
+	for _, selector := range selectors {
+		if selector != "" {
+			nonEmpty = append(nonEmpty, selector)
 		}
 	}
-	return false
+	return nonEmpty
 }
 
-func hasAttr(node *html.Node, attr string) bool {
-	return getAttr(node, attr) != ""
+// The index of the } closing the block opened at open, or len(css) when it's never closed.
+func closingBrace(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); i = skipCssToken(css, i) {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(css)
 }
 
-func getAttr(node *html.Node, attr string) string {
-	for _, item := range node.Attr {
-		if item.Key == attr {
-			return item.Val
+// The index following the token at i, where comments and strings are single tokens.
+func skipCssToken(css string, i int) int {
+	switch c := css[i]; {
+	case strings.HasPrefix(css[i:], "/*"):
+		if end := strings.Index(css[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(css)
+	case c == '"' || c == '\'':
+		for j := i + 1; j < len(css); j++ {
+			if css[j] == '\\' {
+				j++
+			} else if css[j] == c || css[j] == '\n' {
+				return j + 1
+			}
 		}
+		return len(css)
 	}
-	return ""
+	return i + 1
 }
 
-func walk(fileName string, visitor viewGenerator) error {
-	// open input file
-	fi, err := os.Open(fileName)
-	if err != nil {
-		return err
+// The index of the first <style> tag, with or without attributes.
+func indexStyleTag(contents string) int {
+	offset := 0
+	for {
+		i := strings.Index(contents[offset:], "<style")
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		if next := i + len("<style"); next < len(contents) && strings.ContainsRune(" \t\r\n/>", rune(contents[next])) {
+			return i
+		}
+		offset = i + len("<style")
 	}
+}
 
-	// close fi on exit and check for its returned error
-	defer func() {
-		if err := fi.Close(); err != nil {
-			fmt.Println(err.Error())
-			// panic(err)
+// The index of the </style> closing a style block, skipping over any in the block's comments and strings,
+// content: "</style>" for one. Strings end at a line break when they aren't closed, like they do for
+// browsers, and a comment that's never closed ends at the first </style> after it, leaving checkCss to
+// report it.
+func indexStyleClose(css string) int {
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; c {
+		case '<':
+			if strings.HasPrefix(css[i:], "</style>") {
+				return i
+			}
+		case '/':
+			if i+1 < len(css) && css[i+1] == '*' {
+				end := strings.Index(css[i+2:], "*/")
+				if end < 0 {
+					if closeStart := strings.Index(css[i:], "</style>"); closeStart >= 0 {
+						return i + closeStart
+					}
+					return -1
+				}
+				i += end + 3
+			}
+		case '"', '\'':
+			for i++; i < len(css) && css[i] != c && css[i] != '\n'; i++ {
+				if css[i] == '\\' {
+					i++ // Escapes, including escaped quotes, don't end the string.
+				}
+			}
 		}
-	}()
-
-	r := bufio.NewReader(fi)
-	contentsBytes, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
 	}
+	return -1
+}
 
-	contents := string(contentsBytes)
-
-	// slurp off the Css. Doing the shitty hacky thing.
-	start := strings.LastIndex(contents, "<style>")
-	end := strings.LastIndex(contents, "</style>")
-
-	if start >= 0 && end >= 0 {
-		css := contents[start+len("<style>") : end]
-		contents = contents[:start]
-		visitor.setCss(css)
+// Parses the template as a fragment and returns its first node, skipping leading whitespace and
+// comments. The parser drops table parts outside of the elements they belong in, so those get their
+// natural parent element as their context rather than the ParseContext.
+func parseFragmentRoot(contents string, opts *GeneratorOptions) (*html.Node, error) {
+	contextTag := opts.parseContext()
+	if wrappers, ok := tablePartWrappers[firstTagName(contents)]; ok {
+		contextTag = strings.Trim(wrappers[0][strings.LastIndex(wrappers[0], "<"):], "<>") // The innermost wrapper.
 	}
+	context := &html.Node{Type: html.ElementNode, Data: contextTag, DataAtom: atom.Lookup([]byte(contextTag))}
 
-	doc, err := html.Parse(strings.NewReader(contents))
+	nodes, err := html.ParseFragment(strings.NewReader(contents), context)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Depth First traversal. Call the visitor going down the stack, and popping back up.
-	var traverse func(n *html.Node, depth int) error
-	traverse = func(n *html.Node, depth int) error {
-		if n == nil {
-			return fmt.Errorf("Template cannot be empty: %s", fileName)
-		}
-
-		if err := visitor.head(n, depth); err != nil {
-			return err
+	// The nodes come back detached, give them a parent again so the root has siblings like it would
+	// in a document.
+	var rootElem *html.Node
+	for _, n := range nodes {
+		context.AppendChild(n)
+		if rootElem == nil && n.Type != html.CommentNode && (n.Type != html.TextNode || strings.TrimFunc(n.Data, isCollapsibleSpace) != "") {
+			rootElem = n
 		}
+	}
+	return rootElem, nil
+}
 
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			if err := traverse(c, depth+1); err != nil {
-				return err
-			}
-		}
+// Parses the template as a whole document and returns the first node in its body.
+func parseDocumentRoot(contents string) (*html.Node, error) {
+	// The parser drops table parts found outside of a table, so give them the table they need.
+	rootTag := firstTagName(contents)
+	if wrappers, ok := tablePartWrappers[rootTag]; ok {
+		contents = wrappers[0] + contents + wrappers[1]
+	}
 
-		visitor.tail(n, depth)
-		return nil
+	doc, err := html.Parse(strings.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tablePartWrappers[rootTag]; ok {
+		return findElement(doc, rootTag), nil
 	}
 
 	// This Parser returns a well formed document. We only want to start our visitor on the
@@ -417,19 +3928,152 @@ func walk(fileName string, visitor viewGenerator) error {
 		// Zilch
 		return nil
 	}
+	return findRoot(doc), nil
+}
+
+// The parser decodes entities in attribute values. For raw attributes we want the exact source text, so
+// this escapes the ampersands of their values up front, leaving the parser's decoding to undo it. The
+// tokenizer finds the tags so that text and comments which happen to contain the prefix are left alone.
+func preserveRawAttrs(contents, rawPrefix string) string {
+	preserved := &strings.Builder{}
+	z := html.NewTokenizer(strings.NewReader(contents))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		raw := string(z.Raw())
+		if (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && strings.Contains(raw, rawPrefix) {
+			raw = escapeRawAttrValues(raw, rawPrefix)
+		}
+		preserved.WriteString(raw)
+	}
+	return preserved.String()
+}
+
+// Escapes the ampersands in the values of the tag's raw attributes. Only attribute names are matched
+// against the prefix, so a value that happens to contain it is left alone.
+func escapeRawAttrValues(tag, rawPrefix string) string {
+	escaped := &strings.Builder{}
+	last := 0
+	scanAttrs(tag, func(name string, valueStart, valueEnd int) {
+		if valueStart >= 0 && strings.HasPrefix(name, strings.ToLower(rawPrefix)) {
+			escaped.WriteString(tag[last:valueStart])
+			escaped.WriteString(strings.Replace(tag[valueStart:valueEnd], "&", "&amp;", -1))
+			last = valueEnd
+		}
+	})
+	escaped.WriteString(tag[last:])
+	return escaped.String()
+}
+
+// If the root element extends a layout, splices it into the layout's <content> placeholder and returns
+// the layout's root instead. Layouts can themselves extend layouts. The layout's own Css is not pulled
+// in, it belongs to the layout's view (if it has one).
+func applyLayout(fileName string, rootElem *html.Node, opts *GeneratorOptions, chain []string, lines sourceLines, bare bareAttrs) (*html.Node, error) {
+	extendsAttr := opts.specialAttr(ExtendsAttr)
+	if rootElem == nil || !hasAttr(rootElem, extendsAttr) {
+		return rootElem, nil
+	}
+
+	layoutFile := resolveSrc(fileName, getAttr(rootElem, extendsAttr))
+	if contains(chain, layoutFile) {
+		return nil, fmt.Errorf("Layout cycle: %s", strings.Join(append(chain, layoutFile), " -> "))
+	}
+
+	layoutRoot, _, err := parseTemplate(layoutFile, opts, lines, bare)
+	if err != nil {
+		return nil, err
+	}
+	if layoutRoot, err = applyLayout(layoutFile, layoutRoot, opts, append(chain, layoutFile), lines, bare); err != nil {
+		return nil, err
+	}
+
+	placeholder := findElement(layoutRoot, LayoutContentTag)
+	if placeholder == nil {
+		return nil, fmt.Errorf("Layout %s extended by %s has no <%s> placeholder", layoutFile, fileName, LayoutContentTag)
+	}
+
+	if rootElem.Parent != nil {
+		rootElem.Parent.RemoveChild(rootElem)
+	}
+	if placeholder == layoutRoot {
+		return rootElem, nil
+	}
+	placeholder.Parent.InsertBefore(rootElem, placeholder)
+	placeholder.Parent.RemoveChild(placeholder)
+	return layoutRoot, nil
+}
+
+// Template references (nested tomato srcs and layouts) are relative to the referencing template.
+func resolveSrc(fileName, src string) string {
+	return filepath.Join(filepath.Dir(fileName), src)
+}
+
+// Makes sure a tomato's src names an existing template, rather than e.g. the component's name, which
+// would otherwise be turned into a plausible looking but wrong view name.
+func checkTomatoSrc(fileName, src string, opts *GeneratorOptions) error {
+	if filepath.Ext(src) != tomatoFileExtension {
+		if filepath.Ext(src) == "" {
+			return fmt.Errorf("%s: tomato src '%s' isn't a %s template, did you mean '%s%s'?", fileName, src, tomatoFileExtension, src, tomatoFileExtension)
+		}
+		return fmt.Errorf("%s: tomato src '%s' isn't a %s template", fileName, src, tomatoFileExtension)
+	}
+	if !templateExists(resolveSrc(fileName, src), opts) {
+		return fmt.Errorf("%s: tomato src '%s' doesn't exist", fileName, src)
+	}
+	return nil
+}
+
+// Depth first search for the first element with the given tag.
+func findElement(n *html.Node, tagName string) *html.Node {
+	if n.Type == html.ElementNode && strings.ToLower(n.Data) == tagName {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, tagName); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// The markup needed around each table part for the parser to keep it.
+var tablePartWrappers = map[string][2]string{
+	"caption":  {"<table>", "</table>"},
+	"colgroup": {"<table>", "</table>"},
+	"col":      {"<table><colgroup>", "</colgroup></table>"},
+	"thead":    {"<table>", "</table>"},
+	"tbody":    {"<table>", "</table>"},
+	"tfoot":    {"<table>", "</table>"},
+	"tr":       {"<table><tbody>", "</tbody></table>"},
+	"td":       {"<table><tbody><tr>", "</tr></tbody></table>"},
+	"th":       {"<table><tbody><tr>", "</tr></tbody></table>"},
+}
 
-	rootElem := strip(findRoot(doc))
-	return traverse(rootElem, 0)
+// The name of the first tag in the markup, lower cased.
+func firstTagName(contents string) string {
+	z := html.NewTokenizer(strings.NewReader(contents))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			return string(name)
+		}
+	}
 }
 
 // This is a hack for <tr> root elements. The HTML parser doesn't like it. So the fix is to wrap it in a
 // <table _stripMe> Which will get ripped out before tomato generation.
-func strip(rootElem *html.Node) *html.Node {
+func strip(rootElem *html.Node, opts *GeneratorOptions) *html.Node {
 	if rootElem == nil {
 		return rootElem
 	}
 	for _, attr := range rootElem.Attr {
-		if attr.Key == StripMeAttr {
+		if attr.Key == opts.specialAttr(StripMeAttr) {
 			c := firstNonWhiteSpaceChild(rootElem)
 			if c.Data == "tbody" {
 				c = firstNonWhiteSpaceChild(c)
@@ -449,6 +4093,34 @@ func firstNonWhiteSpaceChild(n *html.Node) *html.Node {
 	return n
 }
 
+// Describes where an element is in the template, as the chain of tags leading to it from the root.
+func describeElement(root, node *html.Node) string {
+	description := strings.ToLower(node.Data)
+	for n := node.Parent; n != nil && node != root; n = n.Parent {
+		description = strings.ToLower(n.Data) + " > " + description
+		if n == root {
+			break
+		}
+	}
+	return description
+}
+
+// Builds an expression locating node relative to the root element by walking element children. Paths
+// are used rather than ids since they need nothing extra to be rendered into the DOM.
+func elementPath(root, node *html.Node) string {
+	path := ""
+	for n := node; n != root && n != nil; n = n.Parent {
+		index := 0
+		for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+			if s.Type == html.ElementNode {
+				index++
+			}
+		}
+		path = fmt.Sprintf(".children[%d]", index) + path
+	}
+	return "<HTMLElement>root" + path
+}
+
 func indent(depth int) string {
 	indent := "  "
 	for i := 0; i < depth; i++ {
@@ -471,6 +4143,50 @@ func getViewName(fileName string) string {
 	return strings.ToUpper(viewName[0:1]) + viewName[1:len(viewName)]
 }
 
+// The DOM event interface for an event name, falling back to Event for the ones it doesn't know.
+func eventTypeOf(event string) string {
+	switch strings.ToLower(event) {
+	case "click", "dblclick", "auxclick", "contextmenu", "mousedown", "mouseup", "mousemove", "mouseover",
+		"mouseout", "mouseenter", "mouseleave":
+		return "MouseEvent"
+	case "pointerdown", "pointerup", "pointermove", "pointerover", "pointerout", "pointerenter",
+		"pointerleave", "pointercancel":
+		return "PointerEvent"
+	case "keydown", "keyup", "keypress":
+		return "KeyboardEvent"
+	case "focus", "blur", "focusin", "focusout":
+		return "FocusEvent"
+	case "input", "beforeinput":
+		return "InputEvent"
+	case "wheel":
+		return "WheelEvent"
+	case "touchstart", "touchend", "touchmove", "touchcancel":
+		return "TouchEvent"
+	case "drag", "dragstart", "dragend", "dragenter", "dragleave", "dragover", "drop":
+		return "DragEvent"
+	case "animationstart", "animationend", "animationiteration":
+		return "AnimationEvent"
+	case "transitionstart", "transitionend", "transitionrun", "transitioncancel":
+		return "TransitionEvent"
+	}
+	return "Event"
+}
+
 func debugIdFromViewName(viewName string) string {
-	return viewName[0 : len(viewName)-len("View")]
+	return strings.TrimSuffix(viewName, "View")
+}
+
+// The registry tag of a view, e.g. "user-card" for UserCardView.
+func viewTag(viewName string) string {
+	tag := &stringBuilder{}
+	for i, r := range strings.TrimSuffix(viewName, "View") {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				tag.append("-")
+			}
+			r = unicode.ToLower(r)
+		}
+		tag.append(string(r))
+	}
+	return tag.buffer.String()
 }
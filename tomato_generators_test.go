@@ -0,0 +1,498 @@
+package tomato
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollapseWhitespace(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"single spaces", "a b c", "a b c"},
+		{"runs of spaces", "a   b", "a b"},
+		{"tabs", "a\t\tb\tc", "a b c"},
+		{"multi-line", "first line\n    second line\n\n  third", "first line second line third"},
+		{"windows newlines", "a\r\n\r\nb", "a b"},
+		{"mixed", " \t\n a \n\t b \t\n ", " a b "},
+		{"nbsp kept", "a\u00a0\u00a0b", "a\u00a0\u00a0b"},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		if got := collapseWhitespace(test.text); got != test.want {
+			t.Errorf("%s: collapseWhitespace(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestEscapeRawAttrValues(t *testing.T) {
+	tests := []struct {
+		name, tag, want string
+	}{
+		{"double quoted", `<div _raw:data-x="a&amp;b">`, `<div _raw:data-x="a&amp;amp;b">`},
+		{"single quoted", `<div _raw:data-x='a&b'>`, `<div _raw:data-x='a&amp;b'>`},
+		{"unquoted", `<div _raw:data-x=a&b class="c">`, `<div _raw:data-x=a&amp;b class="c">`},
+		{"prefix in another value", `<div title="_raw:x=a&b" data-y="&amp;">`, `<div title="_raw:x=a&b" data-y="&amp;">`},
+		{"prefix in another value before a raw one", `<div title="_raw:x=&" _raw:y="&">`, `<div title="_raw:x=&" _raw:y="&amp;">`},
+		{"bare raw attribute", `<div _raw:x class="&">`, `<div _raw:x class="&">`},
+		{"upper case name", `<div _RAW:x="&">`, `<div _RAW:x="&amp;">`},
+	}
+	for _, test := range tests {
+		if got := escapeRawAttrValues(test.tag, RawAttrPrefix); got != test.want {
+			t.Errorf("%s: escapeRawAttrValues(%q) = %q, want %q", test.name, test.tag, got, test.want)
+		}
+	}
+}
+
+func TestBareAttrNames(t *testing.T) {
+	got := bareAttrNames(`<input disabled type="checkbox" CHECKED title='a b' data-x=y hidden/>`)
+	want := []string{"disabled", "checked", "hidden"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bareAttrNames = %q, want %q", got, want)
+	}
+}
+
+// Generates a single template from source, failing t on errors.
+func generateSource(t *testing.T, template string, opts *GeneratorOptions) string {
+	t.Helper()
+	views, err := GenerateViewsFromSources(map[string]string{"view.htmto": template}, opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return views["view.htmto"].ViewText
+}
+
+func TestTablePartRoots(t *testing.T) {
+	tests := []struct {
+		name, template, want string
+	}{
+		{"row", `<tr class="r"><td>a</td><td>b</td></tr>`,
+			"super(doc.createElement('tr'));\n\n" +
+				"    this.setAttr('class', 'r')\n" +
+				"      .append(createView('td', doc).appendText('a'))\n" +
+				"      .append(createView('td', doc).appendText('b'));"},
+		{"cell", `<td colspan="2">c</td>`,
+			"super(doc.createElement('td'));\n\n" +
+				"    this.setAttr('colspan', '2').appendText('c');"},
+		{"header cell", `<th>h</th>`,
+			"super(doc.createElement('th'));\n\n" +
+				"    this.appendText('h');"},
+		{"body", `<tbody><tr><td>x</td></tr></tbody>`,
+			"super(doc.createElement('tbody'));\n\n" +
+				"    this\n" +
+				"      .append(createView('tr', doc)\n" +
+				"        .append(createView('td', doc).appendText('x')));"},
+	}
+	for _, test := range tests {
+		if got := generateSource(t, test.template, testOptions()); !strings.Contains(got, test.want) {
+			t.Errorf("%s: got\n%s\nwant it to contain\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAttrTypesSetStrings(t *testing.T) {
+	opts := testOptions()
+	opts.AttrTypes = DefaultAttrTypes
+	got := generateSource(t, `<div><input checked="checked" disabled="false" hidden tabindex=" 2 " maxlength="x"></div>`, opts)
+	want := ".append(createView('input', doc).setAttr('checked', '').setAttr('hidden', '').setAttr('tabindex', '2').setAttr('maxlength', 'x'))"
+	if !strings.Contains(got, want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", got, want)
+	}
+}
+
+func TestAttrPolicyCoversAddedAttrs(t *testing.T) {
+	opts := testOptions()
+	opts.TagRoot = true
+	opts.DeniedAttrs = []string{"data-*", "debug-id"}
+	views, err := GenerateViewsFromSources(map[string]string{"view.htmto": `<div data-x="1" title="t"></div>`}, opts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := views["view.htmto"].ViewText
+	if strings.Contains(got, "data-") || strings.Contains(got, "debug-id") {
+		t.Errorf("denied attributes were set:\n%s", got)
+	}
+	if !strings.Contains(got, "setAttr('title', 't')") {
+		t.Errorf("allowed title attribute wasn't set:\n%s", got)
+	}
+}
+
+func TestMixedInlineContent(t *testing.T) {
+	tests := []struct {
+		name, template, want string
+	}{
+		{"text around inline elements", "<p>Hello <b>bold</b> <i>italic</i> world</p>",
+			"this.appendText('Hello ')\n" +
+				"      .append(createView('b', doc).appendText('bold')).appendText(' ')\n" +
+				"      .append(createView('i', doc).appendText('italic')).appendText(' world');"},
+		{"inline elements on their own lines", "<p>\n  <b>a</b>\n  <i>b</i>\n</p>",
+			"this\n" +
+				"      .append(createView('b', doc).appendText('a')).appendText(' ')\n" +
+				"      .append(createView('i', doc).appendText('b'));"},
+		{"adjacent inline elements", "<p><b>a</b><i>b</i></p>",
+			"this\n" +
+				"      .append(createView('b', doc).appendText('a'))\n" +
+				"      .append(createView('i', doc).appendText('b'));"},
+		{"block elements", "<div>\n  <p>a</p>\n  <p>b</p>\n</div>",
+			"this\n" +
+				"      .append(createView('p', doc).appendText('a'))\n" +
+				"      .append(createView('p', doc).appendText('b'));"},
+	}
+	for _, test := range tests {
+		if got := generateSource(t, test.template, testOptions()); !strings.Contains(got, test.want) {
+			t.Errorf("%s: got\n%s\nwant it to contain\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPassedProps(t *testing.T) {
+	item := `<li _props="label: string; count: number; open?: boolean; note?: string">x</li>`
+	tests := []struct {
+		name, tomato, want, wantErr string
+	}{
+		{"typed", `<tomato src="item.htmto" label="A" count=" 3 " open></tomato>`,
+			"new ItemView({'label': 'A', 'count': 3, 'open': true}, doc)", ""},
+		{"false boolean", `<tomato src="item.htmto" label="A" count="3" open="false"></tomato>`,
+			"new ItemView({'label': 'A', 'count': 3, 'open': false}, doc)", ""},
+		{"camel cased", `<tomato src="item.htmto" LABEL="A" count="3" note="n"></tomato>`,
+			"new ItemView({'label': 'A', 'count': 3, 'note': 'n'}, doc)", ""},
+		{"missing required", `<tomato src="item.htmto" label="A"></tomato>`, "", "requires the prop count"},
+		{"not a number", `<tomato src="item.htmto" label="A" count="many"></tomato>`, "", "prop count is a number, 'many' isn't one"},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.ConstructorStyle = ConstructorOptions
+		views, err := GenerateViewsFromSources(map[string]string{
+			"item.htmto": item,
+			"list.htmto": "<ul>" + test.tomato + "</ul>",
+		}, opts, false)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := views["list.htmto"].ViewText; !strings.Contains(got, test.want) {
+			t.Errorf("%s: got\n%s\nwant it to contain\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNestingDepth(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates map[string]string
+		maxDepth  int
+		wantErr   string
+	}{
+		{"recursive", map[string]string{
+			"a.htmto": `<div><tomato src="b.htmto"></tomato></div>`,
+			"b.htmto": `<div><tomato src="a.htmto" _ref="a"></tomato></div>`,
+		}, 0, "a.htmto -> b.htmto -> a.htmto"},
+		{"self", map[string]string{
+			"a.htmto": `<div><tomato src="a.htmto"></tomato></div>`,
+		}, 0, "a.htmto -> a.htmto"},
+		{"lazy self", map[string]string{
+			"a.htmto": `<div><tomato src="a.htmto" _ref="child" _lazy></tomato></div>`,
+		}, 0, ""},
+		{"too deep", map[string]string{
+			"a.htmto": `<div><tomato src="b.htmto"></tomato></div>`,
+			"b.htmto": `<div><tomato src="c.htmto"></tomato></div>`,
+			"c.htmto": `<p>c</p>`,
+		}, 1, "included more than 1 deep: a.htmto -> b.htmto -> c.htmto"},
+		{"deep enough", map[string]string{
+			"a.htmto": `<div><tomato src="b.htmto"></tomato><tomato src="c.htmto"></tomato></div>`,
+			"b.htmto": `<div><tomato src="c.htmto"></tomato></div>`,
+			"c.htmto": `<p>c</p>`,
+		}, 2, ""},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.StatementStyle = true
+		opts.MaxIncludeDepth = test.maxDepth
+		_, err := GenerateViewsFromSources(test.templates, opts, false)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestScopeSelectors(t *testing.T) {
+	scope := `[data-s="x"]`
+	tests := []struct {
+		name, css, want string
+	}{
+		{"class", ".a { color: red; }", `[data-s="x"].a, [data-s="x"] .a { color: red; }`},
+		{"type", "div > p {}", `div[data-s="x"] > p, [data-s="x"] div > p {}`},
+		{"type and class", "li.on:hover {}", `li[data-s="x"].on:hover, [data-s="x"] li.on:hover {}`},
+		{"universal", "* {}", `*[data-s="x"], [data-s="x"] * {}`},
+		{"list", ".a, p {}", `[data-s="x"].a, [data-s="x"] .a, p[data-s="x"], [data-s="x"] p {}`},
+		{"media", "@media (x) { .a {} }", `@media (x) { [data-s="x"].a, [data-s="x"] .a {} }`},
+		{"keyframes left alone", "@keyframes k { from {} }", "@keyframes k { from {} }"},
+	}
+	for _, test := range tests {
+		if got := scopeSelectors(test.css, scope); got != test.want {
+			t.Errorf("%s: scopeSelectors(%q) = %q, want %q", test.name, test.css, got, test.want)
+		}
+	}
+}
+
+func TestBareAttrsAsBooleans(t *testing.T) {
+	opts := testOptions()
+	opts.BareAttrsAsBooleans = true
+	opts.SkipEmptyAttrs = true
+	opts.AttrTypes = map[string]string{"tabindex": AttrNumber}
+	got := generateSource(t, `<div><input disabled tabindex title=""></div>`, opts)
+	want := ".append(createView('input', doc).setAttr('disabled', '').setAttr('tabindex', ''))"
+	if !strings.Contains(got, want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", got, want)
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		name, text                  string
+		single, double, templateLit string
+	}{
+		{"plain", "a b", `'a b'`, `"a b"`, "`a b`"},
+		{"backslash", `a\b`, `'a\\b'`, `"a\\b"`, "`a\\\\b`"},
+		{"newline", "a\nb", `'a\nb'`, `"a\nb"`, "`a\\nb`"},
+		{"carriage return", "a\r\nb", `'a\r\nb'`, `"a\r\nb"`, "`a\\r\\nb`"},
+		{"line separators", "a\u2028b\u2029c", "'a\\u2028b\\u2029c'", `"a\u2028b\u2029c"`, "`a\\u2028b\\u2029c`"},
+		{"quotes", "'\"`", `'\'"` + "`'", `"'\"` + "`\"", "`'\"\\``"},
+		{"interpolation", "${x} $y {z}", `'${x} $y {z}'`, `"${x} $y {z}"`, "`\\${x} $y {z}`"},
+		{"escaped interpolation", `\${x}`, `'\\${x}'`, `"\\${x}"`, "`\\\\\\${x}`"},
+	}
+	for _, test := range tests {
+		for style, want := range map[literalStyle]string{singleQuoted: test.single, doubleQuoted: test.double, templateLiteral: test.templateLit} {
+			if got := quoteLiteral(test.text, style); got != want {
+				t.Errorf("%s: quoteLiteral(%q, %d) = %s, want %s", test.name, test.text, style, got, want)
+			}
+		}
+	}
+}
+
+func TestParseStyle(t *testing.T) {
+	tests := []struct {
+		name, style string
+		want        []styleDecl
+	}{
+		{"simple", "color: red; margin: 0", []styleDecl{{"color", "red", false}, {"margin", "0", false}}},
+		{"quoted separators", `content: "a;b:c"; font-family: 'x;y'`, []styleDecl{{"content", `"a;b:c"`, false}, {"font-family", `'x;y'`, false}}},
+		{"data url", "background: url(data:image/png;base64,AAA=); color: red",
+			[]styleDecl{{"background", "url(data:image/png;base64,AAA=)", false}, {"color", "red", false}}},
+		{"escaped quotes", `content: "a\";b"; color: red`, []styleDecl{{"content", `"a\";b"`, false}, {"color", "red", false}}},
+		{"important", "color: red !important; margin: 0 ! IMPORTANT", []styleDecl{{"color", "red", true}, {"margin", "0", true}}},
+		{"empty declarations", " ; color: red;; ;", []styleDecl{{"color", "red", false}}},
+		{"trailing semicolon", "color: red;", []styleDecl{{"color", "red", false}}},
+		{"empty", "", nil},
+	}
+	for _, test := range tests {
+		got := parseStyle(test.style)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: parseStyle(%q) = %v, want %v", test.name, test.style, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: parseStyle(%q) = %v, want %v", test.name, test.style, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAppendGuards(t *testing.T) {
+	opts := testOptions()
+	opts.StatementStyle = true
+	opts.AppendGuards = true
+	opts.DevGuard = "DEV"
+	opts.SplitConstruction = true
+	opts.FragmentThreshold = 2
+	views, err := GenerateViewsFromSources(map[string]string{
+		"card.htmto": `<div><ul><li>a</li><li>b</li></ul><tomato src="item.htmto" _ref="item"></tomato></div>`,
+		"item.htmto": `<li>i</li>`,
+	}, opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := views["card.htmto"].ViewText
+	for _, want := range []string{
+		"const a3 = this.build1(doc);\n    if (DEV) assertDetached(a3);\n    f1.append(a3);",
+		"const e7 = this.item = <ItemView>new ItemView(doc);\n    if (DEV) assertDetached(e7);\n    f1.append(e7);",
+		"if (DEV) assertDetached(f1);\n    this.append(f1);",
+		"if (DEV) assertDetached(e5);\n    f4.append(e5);",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got\n%s\nwant it to contain\n%s", got, want)
+		}
+	}
+}
+
+func TestElementRefs(t *testing.T) {
+	template := `<div><header _ref="header">h</header><p _ref="body">b</p></div>`
+	colliding := `<div><header _ref="header">h</header><p _ref="headerEl">b</p></div>`
+	tests := []struct {
+		name     string
+		refs     ElementRefs
+		template string
+		want     []string
+		wantErr  string
+	}{
+		{"view", ViewRefs, template, []string{"header: View;", "const e1 = this.header = createView('header', doc);"}, ""},
+		{"view and element", ViewAndElementRefs, template,
+			[]string{"header: View;", "headerEl: HTMLElement;", "const e1 = this.header = createView('header', doc);\n    this.headerEl = <HTMLElement>e1.elem();"}, ""},
+		{"element", ElementOnlyRefs, template,
+			[]string{"headerEl: HTMLElement;", "const e1 = createView('header', doc);\n    this.headerEl = <HTMLElement>e1.elem();"}, ""},
+		{"view colliding", ViewRefs, colliding, []string{"header: View;", "headerEl: View;"}, ""},
+		{"view and element colliding", ViewAndElementRefs, colliding, nil, "the element ref of header would be headerEl, which is already a ref"},
+		{"element colliding", ElementOnlyRefs, colliding, nil, "the element ref of header would be headerEl, which is already a ref"},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.StatementStyle = true
+		opts.ElementRefs = test.refs
+		views, err := GenerateViewsFromSources(map[string]string{"view.htmto": test.template}, opts, false)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := views["view.htmto"].ViewText
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: got\n%s\nwant it to contain\n%s", test.name, got, want)
+			}
+		}
+		if test.refs == ElementOnlyRefs && strings.Contains(got, "header: View;") {
+			t.Errorf("%s: got a view ref:\n%s", test.name, got)
+		}
+	}
+}
+
+func TestIndexStyleClose(t *testing.T) {
+	tests := []struct {
+		name, css string
+		want      int
+	}{
+		{"plain", `.a {}</style>`, 5},
+		{"none", `.a {}`, -1},
+		{"in a comment", `/* </style> */.a {}</style>`, 19},
+		{"in a double quoted value", `.a { content: "</style>"; }</style>`, 27},
+		{"in a single quoted value", `.a { content: '</style>'; }</style>`, 27},
+		{"escaped quotes", `.a { content: "\"</style>\\"; }</style>`, 31},
+		{"unterminated string", ".a { content: \"x\n}</style>", 18},
+		{"unclosed comment", `.a {} /* x </style> y`, 11},
+	}
+	for _, test := range tests {
+		if got := indexStyleClose(test.css); got != test.want {
+			t.Errorf("%s: indexStyleClose(%q) = %d, want %d", test.name, test.css, got, test.want)
+		}
+	}
+}
+
+func TestStrictMarkupSkipsStyles(t *testing.T) {
+	opts := testOptions()
+	opts.StrictMarkup = true
+	opts.Strict = true
+	got := generateSource(t, "<div>\n<style>\n.a { content: \"</style>\"; }\n</style>\n<p>a</p>\n</div>", opts)
+	if !strings.Contains(got, "createView('p', doc)") {
+		t.Errorf("got\n%s", got)
+	}
+
+	_, err := GenerateViewsFromSources(map[string]string{"view.htmto": "<div>\n<style>\n.a { content: \"</style>\"; }\n</style>\n</p>\n</div>"}, opts, false)
+	if err == nil || !strings.Contains(err.Error(), ":5:") {
+		t.Errorf("got error %v, want one on line 5", err)
+	}
+}
+
+func TestChildlessRoot(t *testing.T) {
+	for _, statements := range []bool{false, true} {
+		opts := testOptions()
+		opts.StatementStyle = statements
+		got := generateSource(t, `<div></div>`, opts)
+		want := "  constructor(doc: Document = document) {\n" +
+			"    super(doc.createElement('div'));\n" +
+			"  }\n"
+		if !strings.Contains(got, want) || strings.Contains(got, "this;") {
+			t.Errorf("statements %v: got\n%s\nwant a constructor of just\n%s", statements, got, want)
+		}
+	}
+}
+
+func TestDatasetKey(t *testing.T) {
+	tests := []struct {
+		attr, want string
+	}{
+		{"data-user-id", "userId"},
+		{"data-x", "x"},
+		{"data-a--b", ""}, // a-B, which isn't an identifier.
+		{"data-x-", ""},
+		{"data-1x", ""},
+		{"data-", ""},
+		{"title", ""},
+	}
+	for _, test := range tests {
+		if got := datasetKey(test.attr); got != test.want {
+			t.Errorf("datasetKey(%q) = %q, want %q", test.attr, got, test.want)
+		}
+	}
+
+	opts := testOptions()
+	opts.DatasetMethod = "setData"
+	got := generateSource(t, `<div data-user-id="7" data-1x="y"></div>`, opts)
+	want := "this.setData('userId', '7').setAttr('data-1x', 'y');"
+	if !strings.Contains(got, want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", got, want)
+	}
+}
+
+func TestSanitizeIdentifier(t *testing.T) {
+	tests := []struct {
+		name, s, want string
+	}{
+		{"identifier", "myView", "myView"},
+		{"leading digit", "1col", "_1col"},
+		{"dashes and dots", "my-view.v2", "myViewV2"},
+		{"leading punctuation", "-view", "view"},
+		{"all punctuation", "-.-", "_"},
+		{"empty", "", "_"},
+		{"non-ASCII letters", "café-menü", "caféMenü"},
+		{"non-ASCII upper casing", "a-ñu", "aÑu"},
+	}
+	for _, test := range tests {
+		if got := sanitizeIdentifier(test.s); got != test.want {
+			t.Errorf("%s: sanitizeIdentifier(%q) = %q, want %q", test.name, test.s, got, test.want)
+		}
+	}
+}
+
+func TestValidateCss(t *testing.T) {
+	tests := []struct {
+		name, template, wantErr string
+	}{
+		{"balanced", "<div>\n<style>\n.a { content: '{'; }\n@media (x) { .b {} }\n</style>\n</div>", ""},
+		{"unbalanced", "<div>\n<style>\n.a { color: red; }\n.b { color: blue;\n</style>\n</div>", "view.htmto:4: { is never closed"},
+		{"stray close", "<div>\n<style>\n.a {}\n}\n</style>\n</div>", "view.htmto:4: } doesn't close any block"},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.ValidateCss = true
+		opts.Strict = true
+		_, err := GenerateViewsFromSources(map[string]string{"view.htmto": test.template}, opts, false)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package tomato
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+///////////////////
+// HTML IMPL
+//////////////////
+
+// Writes the templates back out as HTML, after tomato's parsing and normalization (_stripme unwrapping,
+// layouts, <style> extraction and so on). Useful as a formatter for diffing a corpus of templates. The
+// special attributes are kept, so the output still works as templates.
+type htmlGenerator struct {
+	*GeneratorOptions //inherits
+
+	templates *templateCache
+}
+
+type htmlVisitor struct {
+	visitorData // inherits
+}
+
+func (*htmlGenerator) EmitPreamble(buffer *bytes.Buffer) {
+}
+
+func (*htmlGenerator) EmitPostamble(buffer *bytes.Buffer) {
+}
+
+func (g *htmlGenerator) GenerateViews(files *list.List, forceDebugIds bool) (map[string]*View, error) {
+	templates, err := loadTemplates(files, g.GeneratorOptions)
+	if err != nil {
+		return nil, err
+	}
+	return g.generateViews(templates, forceDebugIds)
+}
+
+func (g *htmlGenerator) generateViews(templates *list.List, forceDebugIds bool) (map[string]*View, error) {
+	g.templates = newTemplateCache(templates, g.GeneratorOptions)
+	views := make(map[string]*View)
+	for e := templates.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*template)
+		view, err := g.generateView(t, forceDebugIds)
+		if err != nil {
+			return nil, err
+		}
+		views[t.fileName] = view
+		g.Logger.Infof("formatted %s", t.fileName)
+		if g.OnViewGenerated != nil {
+			g.OnViewGenerated(g.viewName(t.fileName), t.fileName, view)
+		}
+	}
+	return views, nil
+}
+
+func (g *htmlGenerator) generateView(t *template, forceDebugIds bool) (*View, error) {
+	visitor := htmlVisitor{visitorData: visitorData{
+		GeneratorOptions: g.GeneratorOptions,
+		forceDebugIds:    forceDebugIds,
+		viewName:         g.viewName(t.fileName),
+		fileName:         t.fileName,
+		templates:        g.templates,
+	}}
+
+	if err := walk(t, &visitor); err != nil {
+		return nil, err
+	}
+	return &View{
+		ViewText: generateView(&visitor),
+		CssText:  visitor.getCss(),
+	}, nil
+}
+
+// Nested templates are referenced by their src, there's nothing to import.
+func (*htmlGenerator) emitImport(buffer *bytes.Buffer, viewNames []string, from string) {
+}
+
+func (*htmlGenerator) emitRegistry(buffer *bytes.Buffer, viewNames []string) {
+}
+
+func (*htmlGenerator) emitViewNameEnum(buffer *bytes.Buffer, viewNames []string) {
+}
+
+// The templates don't depend on the view library.
+func (*htmlGenerator) emitPreamble(buffer *bytes.Buffer, imports []runtimeImport) {
+}
+
+// Templates aren't modules.
+func (*htmlGenerator) emitHotModuleReplacement(buffer *bytes.Buffer, moduleId string) {
+}
+
+func (*htmlGenerator) commentLine(text string) string {
+	return "<!-- " + strings.Replace(text, "--", "- -", -1) + " -->"
+}
+
+// The whole tree is rendered from the root, so there's nothing to do on the way down but find it.
+func (v *htmlVisitor) head(node *html.Node, depth int) error {
+	if depth == 0 {
+		v.root = node
+	}
+	return nil
+}
+
+func (v *htmlVisitor) tail(node *html.Node, depth int) {
+}
+
+func (v *htmlVisitor) transferAttrs(node *html.Node, builder *stringBuilder) error {
+	return nil
+}
+
+func (v *htmlVisitor) emitPreamble() {
+	v.output.append("<!-- ").append(v.viewName).append(" -->\n")
+}
+
+func (v *htmlVisitor) emitElementRefs() {
+}
+
+func (v *htmlVisitor) emitDomConstruction() {
+	// Rendered from a copy, since the templates are shared with the other targets.
+	root := v.cloneForRender(v.root)
+	if err := html.Render(&v.output.buffer, root); err != nil {
+		v.Logger.Warn(Diagnostic{File: v.fileName, Message: err.Error()})
+	}
+	v.output.append("\n")
+}
+
+func (v *htmlVisitor) emitHydration() {
+}
+
+func (v *htmlVisitor) emitPostamble() {
+}
+
+func (v *htmlVisitor) getView() string {
+	return v.output.buffer.String()
+}
+
+func (v *htmlVisitor) setCss(cssText string) {
+	v.cssText = cssText
+}
+
+func (v *htmlVisitor) getCss() string {
+	return v.cssText
+}
+
+// Deep copies a node without its siblings. The values of raw attributes are kept escaped by parsing, so
+// they're unescaped here for html.Render to escape them back to what was written.
+func (v *htmlVisitor) cloneForRender(n *html.Node) *html.Node {
+	clone := &html.Node{Type: n.Type, DataAtom: n.DataAtom, Data: n.Data, Namespace: n.Namespace}
+	rawPrefix := v.specialAttr(RawAttrPrefix)
+	for _, attr := range n.Attr {
+		if strings.HasPrefix(attr.Key, rawPrefix) {
+			attr.Val = html.UnescapeString(attr.Val)
+		}
+		clone.Attr = append(clone.Attr, attr)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		clone.AppendChild(v.cloneForRender(c))
+	}
+	return clone
+}
@@ -0,0 +1,333 @@
+package tomato
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+///////////////////
+// HYPERSCRIPT IMPL
+//////////////////
+
+// Writes each view as a function returning its tree as nested calls to a hyperscript function, h('div',
+// {'class': 'card'}, 'Hello'), for JSX style runtimes rather than the view library. Element refs become
+// ref props, callbacks setting the element on the refs object handed to the view's function, so the
+// runtime's h has to call ref props with the element they're on. A nested view with a ref gets a refs
+// object of its own, kept under its ref. Listeners aren't supported.
+type hyperscriptGenerator struct {
+	*GeneratorOptions //inherits
+
+	templates *templateCache
+}
+
+type hyperscriptVisitor struct {
+	visitorData // inherits
+}
+
+func (g *hyperscriptGenerator) EmitPreamble(buffer *bytes.Buffer) {
+	g.emitPreamble(buffer, nil)
+}
+
+func (*hyperscriptGenerator) EmitPostamble(buffer *bytes.Buffer) {
+}
+
+func (g *hyperscriptGenerator) GenerateViews(files *list.List, forceDebugIds bool) (map[string]*View, error) {
+	templates, err := loadTemplates(files, g.GeneratorOptions)
+	if err != nil {
+		return nil, err
+	}
+	return g.generateViews(templates, forceDebugIds)
+}
+
+func (g *hyperscriptGenerator) generateViews(templates *list.List, forceDebugIds bool) (map[string]*View, error) {
+	g.templates = newTemplateCache(templates, g.GeneratorOptions)
+	views := make(map[string]*View)
+	for e := templates.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*template)
+		view, err := g.generateView(t, forceDebugIds)
+		if err != nil {
+			return nil, err
+		}
+		views[t.fileName] = view
+		g.Logger.Infof("generated %s from %s", g.viewName(t.fileName), t.fileName)
+		if g.OnViewGenerated != nil {
+			g.OnViewGenerated(g.viewName(t.fileName), t.fileName, view)
+		}
+	}
+	return views, nil
+}
+
+func (g *hyperscriptGenerator) generateView(t *template, forceDebugIds bool) (*View, error) {
+	if g.templates == nil {
+		g.templates = newTemplateCache(list.New(), g.GeneratorOptions)
+	}
+	if viewName := g.viewName(t.fileName); !isIdentifier(viewName) {
+		return nil, fmt.Errorf("%s: the view name %s isn't a valid function name, rename the template or set SanitizeViewNames", t.fileName, viewName)
+	}
+	visitor := hyperscriptVisitor{visitorData: visitorData{
+		GeneratorOptions: g.GeneratorOptions,
+		forceDebugIds:    forceDebugIds,
+		viewName:         g.viewName(t.fileName),
+		fileName:         t.fileName,
+		templates:        g.templates,
+		lines:            t.lines,
+	}}
+
+	if err := g.templates.checkNesting(t.fileName); err != nil {
+		return nil, err
+	}
+	if err := walk(t, &visitor); err != nil {
+		return nil, err
+	}
+	stats := visitor.stats
+	stats.Refs = visitor.refs.Len()
+	return &View{
+		ViewText:    generateView(&visitor),
+		CssText:     visitor.getCss(),
+		Stats:       stats,
+		nestedViews: visitor.nestedViews,
+	}, nil
+}
+
+func (g *hyperscriptGenerator) emitImport(buffer *bytes.Buffer, viewNames []string, from string) {
+	refs := make([]string, 0, 2*len(viewNames))
+	for _, viewName := range viewNames {
+		refs = append(refs, g.className(viewName), g.className(viewName)+"Refs")
+	}
+	buffer.WriteString("\nimport { ")
+	buffer.WriteString(strings.Join(refs, ", "))
+	buffer.WriteString(" } from '")
+	buffer.WriteString(from)
+	buffer.WriteString("';")
+}
+
+// The views only need the hyperscript function, rather than the view library.
+func (g *hyperscriptGenerator) emitPreamble(buffer *bytes.Buffer, imports []runtimeImport) {
+	buffer.WriteString("import { ")
+	buffer.WriteString(g.hyperscriptFunction())
+	buffer.WriteString(" } from '")
+	buffer.WriteString(g.ImportLocation)
+	buffer.WriteString("';")
+}
+
+func (g *hyperscriptGenerator) emitRegistry(buffer *bytes.Buffer, viewNames []string) {
+	(&typeScriptGenerator{GeneratorOptions: g.GeneratorOptions}).emitRegistry(buffer, viewNames)
+}
+
+func (g *hyperscriptGenerator) emitViewNameEnum(buffer *bytes.Buffer, viewNames []string) {
+	(&typeScriptGenerator{GeneratorOptions: g.GeneratorOptions}).emitViewNameEnum(buffer, viewNames)
+}
+
+func (g *hyperscriptGenerator) emitHotModuleReplacement(buffer *bytes.Buffer, moduleId string) {
+	(&typeScriptGenerator{GeneratorOptions: g.GeneratorOptions}).emitHotModuleReplacement(buffer, moduleId)
+}
+
+func (*hyperscriptGenerator) commentLine(text string) string {
+	return "// " + text
+}
+
+// The whole tree is written out from the root, as the one nested expression.
+func (v *hyperscriptVisitor) head(node *html.Node, depth int) error {
+	if depth > 0 {
+		return nil
+	}
+	v.root = node
+	tree, err := v.render(node, 1)
+	if err != nil {
+		return err
+	}
+	v.domConstruction.append(tree)
+	return nil
+}
+
+func (v *hyperscriptVisitor) tail(node *html.Node, depth int) {
+}
+
+// The hyperscript call building an element, or the string for a run of text. Whitespace the browser
+// wouldn't render comes back empty.
+func (v *hyperscriptVisitor) render(node *html.Node, depth int) (string, error) {
+	switch node.Type {
+	case html.TextNode:
+		if !startsTextRun(node) {
+			return "", nil
+		}
+		text, last := textRun(node)
+		if "" == strings.TrimFunc(text, isCollapsibleSpace) && !separatesInlineElements(node, last) {
+			return "", nil
+		}
+		return "'" + escapeText(collapseWhitespace(text)) + "'", nil
+	case html.ElementNode:
+	default:
+		return "", nil
+	}
+
+	tagName := strings.ToLower(node.Data)
+	v.stats.Elements++
+	if depth-1 > v.stats.MaxDepth {
+		v.stats.MaxDepth = depth - 1
+	}
+	if tagName == v.includeTag() {
+		return v.renderTomato(node)
+	}
+
+	props, err := v.props(node)
+	if err != nil {
+		return "", err
+	}
+	var children []string
+	nested := false
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		child, err := v.render(c, depth+1)
+		if err != nil {
+			return "", err
+		}
+		if child != "" {
+			children = append(children, child)
+			nested = nested || c.Type == html.ElementNode
+		}
+	}
+
+	call := &stringBuilder{}
+	call.append(v.hyperscriptFunction()).append("('").append(tagName).append("', ").append(props)
+	for _, child := range children {
+		if nested {
+			call.append(",").append(indent(depth - 1)).append(child)
+		} else {
+			call.append(", ").append(child)
+		}
+	}
+	call.append(")")
+	return call.buffer.String(), nil
+}
+
+// Nested views are called, with a refs object of their own when they have a ref.
+func (v *hyperscriptVisitor) renderTomato(node *html.Node) (string, error) {
+	src := getAttr(node, "src")
+	if src == "" {
+		return "", fmt.Errorf("%s: %s: tomato element with no 'src' attribute", v.fileName, describeElement(v.root, node))
+	} else if err := checkTomatoSrc(v.fileName, src, v.GeneratorOptions); err != nil {
+		return "", err
+	}
+	for _, attr := range node.Attr {
+		if attr.Key != "src" && attr.Key != v.specialAttr(FieldRefAttr) {
+			if err := v.warn(node, "attribute "+attr.Key+" isn't passed on to the nested view"); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	nestedName := v.GeneratorOptions.viewName(resolveSrc(v.fileName, src))
+	v.stats.NestedTomatos++
+	if !contains(v.nestedViews, nestedName) {
+		v.nestedViews = append(v.nestedViews, nestedName)
+	}
+	viewName := v.className(nestedName)
+	if ref := getAttr(node, v.specialAttr(FieldRefAttr)); ref != "" {
+		v.refs.PushBack(ref + "?: " + viewName + "Refs")
+		return viewName + "(refs." + ref + " = {})", nil
+	}
+	return viewName + "()", nil
+}
+
+// The props object of an element's attributes and ref, or null without any.
+func (v *hyperscriptVisitor) props(node *html.Node) (string, error) {
+	var props []string
+	if node == v.root && v.forceDebugIds && !hasAttr(node, v.debugIdAttr()) {
+		if allowed, err := v.addedAttrAllowed(node, v.debugIdAttr()); err != nil {
+			return "", err
+		} else if allowed {
+			props = append(props, "'"+v.debugIdAttr()+"': '"+escapeText(debugIdFromViewName(v.viewName))+"'")
+		}
+	}
+	for _, attr := range node.Attr {
+		if strings.HasPrefix(attr.Key, v.specialAttr(EventAttrPrefix)) {
+			return "", fmt.Errorf("%s: %s: %s listeners aren't supported by the Hyperscript language", v.fileName, describeElement(v.root, node), attr.Key)
+		}
+		if v.isBlockedAttr(attr.Key) {
+			continue
+		}
+
+		key := attr.Key
+		if v.specialAttr(TunnelledIdAttr) == attr.Key {
+			key = IdAttr
+		} else if rawPrefix := v.specialAttr(RawAttrPrefix); strings.HasPrefix(key, rawPrefix) {
+			key = key[len(rawPrefix):]
+		}
+		if !v.attrAllowed(key) {
+			if err := v.warn(node, "attribute "+key+" isn't allowed, dropping it"); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if attr.Namespace != "" {
+			key = attr.Namespace + ":" + key
+		}
+
+		condition, val, conditional := parseConditionalAttr(attr.Val)
+		if val == "" && !conditional && v.SkipEmptyAttrs && attr.Namespace == "" {
+			continue
+		}
+		valueExpr := "'" + escapeText(val) + "'"
+		if conditional {
+			valueExpr = "(" + condition + ") ? " + valueExpr + " : undefined"
+		}
+		props = append(props, "'"+escapeText(key)+"': "+valueExpr)
+	}
+
+	if ref := getAttr(node, v.specialAttr(FieldRefAttr)); ref != "" {
+		v.refs.PushBack(ref + "?: HTMLElement")
+		props = append(props, "ref: (e: HTMLElement) => { refs."+ref+" = e; }")
+	}
+	if len(props) == 0 {
+		return "null", nil
+	}
+	return "{" + strings.Join(props, ", ") + "}", nil
+}
+
+func (v *hyperscriptVisitor) transferAttrs(node *html.Node, builder *stringBuilder) error {
+	return nil
+}
+
+func (v *hyperscriptVisitor) emitPreamble() {
+}
+
+// The refs are described by an interface, the type of the view function's refs object.
+func (v *hyperscriptVisitor) emitElementRefs() {
+	v.output.append("\nexport interface ").append(v.className(v.viewName)).append("Refs {")
+	for e := v.refs.Front(); e != nil; e = e.Next() {
+		v.output.append("\n  ").append(e.Value.(string)).append(";")
+	}
+	if v.refs.Len() > 0 {
+		v.output.append("\n")
+	}
+	v.output.append("}\n\n")
+}
+
+func (v *hyperscriptVisitor) emitDomConstruction() {
+	v.output.append("export function ").append(v.className(v.viewName)).append("(refs: ").
+		append(v.className(v.viewName)).append("Refs = {}) {")
+	v.output.append("\n  return ").append(v.domConstruction.buffer.String()).append(";")
+}
+
+func (v *hyperscriptVisitor) emitHydration() {
+}
+
+func (v *hyperscriptVisitor) emitPostamble() {
+	v.output.append("\n}\n")
+}
+
+func (v *hyperscriptVisitor) getView() string {
+	return v.output.buffer.String()
+}
+
+func (v *hyperscriptVisitor) setCss(cssText string) {
+	v.cssText = cssText
+}
+
+func (v *hyperscriptVisitor) getCss() string {
+	return v.cssText
+}
@@ -0,0 +1,94 @@
+package tomato
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Verbosity levels for the messages reported while generating views.
+type LogLevel int
+
+const (
+	LogQuiet   LogLevel = iota - 1 // Nothing is logged. Errors are still returned.
+	LogNormal                      // Warnings are logged.
+	LogVerbose                     // Warnings plus progress for every generated file.
+)
+
+// Severities of Diagnostics.
+const (
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// A problem found in a template. Warnings are logged, errors are returned (as *Diagnostic) by the
+// generation they stop. Written out as JSON, a list of them is what CI annotations are made from.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`   // Zero when unknown.
+	Column   int    `json:"column,omitempty"` // Zero when unknown.
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (d *Diagnostic) Error() string {
+	return d.String()
+}
+
+func (d Diagnostic) String() string {
+	position := d.File
+	if d.Line > 0 {
+		position += ":" + strconv.Itoa(d.Line)
+		if d.Column > 0 {
+			position += ":" + strconv.Itoa(d.Column)
+		}
+	}
+	return position + ": " + d.Message
+}
+
+// Destination for the warnings and progress messages produced during generation. A nil Logger
+// discards everything.
+type Logger struct {
+	Out   io.Writer
+	Level LogLevel
+
+	// Whether or not to keep the warnings in Diagnostics, whatever the Level. Templates' element lines
+	// are tracked for them too.
+	KeepDiagnostics bool
+	Diagnostics     []Diagnostic
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogVerbose, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogNormal, "warning: "+format, args...)
+}
+
+// Logs a warning about a template, keeping it when KeepDiagnostics. Warnings repeated by generating
+// several targets are only kept once.
+func (l *Logger) Warn(d Diagnostic) {
+	d.Severity = SeverityWarning
+	l.Warnf("%s", d.String())
+	if l == nil || !l.KeepDiagnostics {
+		return
+	}
+	for _, kept := range l.Diagnostics {
+		if kept == d {
+			return
+		}
+	}
+	l.Diagnostics = append(l.Diagnostics, d)
+}
+
+func (l *Logger) keepsDiagnostics() bool {
+	return l != nil && l.KeepDiagnostics
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if l == nil || l.Out == nil || l.Level < level {
+		return
+	}
+	fmt.Fprintf(l.Out, format+"\n", args...)
+}
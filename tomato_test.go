@@ -0,0 +1,247 @@
+package tomato
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testOptions() *GeneratorOptions {
+	return &GeneratorOptions{
+		ViewBaseClass:  "View",
+		ViewFactory:    "createView",
+		ImportLocation: "../ts/view",
+		Logger:         &Logger{Out: ioutil.Discard},
+	}
+}
+
+// Writes the templates into a fresh directory, returning it.
+func writeTemplates(t *testing.T, templates map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tomato")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, contents := range templates {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestScaffoldedViewsBuildSubclasses(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"views/card.htmto": `<div><tomato src="item.htmto" _ref="item"></tomato></div>`,
+		"views/item.htmto": `<li>item</li>`,
+	})
+	opts := testOptions()
+	opts.ScaffoldDir = filepath.Join(dir, "stubs")
+	opts.RegisterFunction = "registerView"
+	outFile := filepath.Join(dir, "gen", "views.ts")
+	if err := GenerateTomatoes(filepath.Join(dir, "views"), outFile, TypeScript, opts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	views := readFile(t, outFile)
+	for _, want := range []string{
+		"import type { ItemView } from '../stubs/ItemView';",
+		"static subclass: typeof ItemViewBase = ItemViewBase;",
+		"item: ItemView;",
+		"this.item = <ItemView>new ItemViewBase.subclass(doc)",
+	} {
+		if !strings.Contains(views, want) {
+			t.Errorf("generated views are missing %q:\n%s", want, views)
+		}
+	}
+	if strings.Contains(views, "registerView") {
+		t.Errorf("generated views register the Base classes:\n%s", views)
+	}
+
+	stub := readFile(t, filepath.Join(dir, "stubs", "ItemView.ts"))
+	want := "import { ItemViewBase } from '../gen/views';\n" +
+		"import { registerView } from '../ts/view';\n" +
+		"\nexport class ItemView extends ItemViewBase {\n}\n" +
+		"\nItemViewBase.subclass = ItemView;\n" +
+		"registerView('ItemView', ItemView);\n"
+	if stub != want {
+		t.Errorf("ItemView stub = %q, want %q", stub, want)
+	}
+}
+
+func TestSeparators(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"a.htmto": "<a>a<style>.a {}</style></a>",
+		"b.htmto": "<b>b<style>.b {}</style></b>",
+	})
+	view := func(name, tag string) string {
+		return "\nexport class " + name + " extends View {\n" +
+			"  constructor(doc: Document = document) {\n" +
+			"    super(doc.createElement('" + tag + "'));\n\n" +
+			"    this.appendText('" + tag + "');\n" +
+			"  }\n}\n"
+	}
+	empty, dashes := "", "\n// --\n"
+	tests := []struct {
+		name                        string
+		viewSeparator, cssSeparator *string
+		wantViews, wantCss          string
+	}{
+		{"default", nil, nil, view("AView", "a") + "\n\n" + view("BView", "b"), ".a {}\n\n.b {}"},
+		{"custom", &dashes, &dashes, view("AView", "a") + "\n// --\n" + view("BView", "b"), ".a {}\n// --\n.b {}"},
+		{"empty", &empty, &empty, view("AView", "a") + view("BView", "b"), ".a {}.b {}"},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.ViewSeparator, opts.CssSeparator = test.viewSeparator, test.cssSeparator
+		outFile := filepath.Join(dir, test.name, "views.ts")
+		if err := GenerateTomatoes(dir, outFile, TypeScript, opts, false); err != nil {
+			t.Fatal(err)
+		}
+
+		wantViews := "import { View, createView } from '../ts/view';" + test.wantViews
+		if got := readFile(t, outFile); got != wantViews {
+			t.Errorf("%s: views = %q, want %q", test.name, got, wantViews)
+		}
+		if got := readFile(t, filepath.Join(dir, test.name, "views.scss")); got != test.wantCss {
+			t.Errorf("%s: Css = %q, want %q", test.name, got, test.wantCss)
+		}
+	}
+}
+
+func TestOverriddenEnumsAndRegisterAreImported(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"plain.htmto":               `<p>plain</p>`,
+		"live/status.htmto":         `<p aria-live="polite">status</p>`,
+		"live/" + tomatoOptionsFile: `{"AttrEnums": {"aria-live": "AriaLive"}, "EnumsImportLocation": "../ts/enums", "RegisterFunction": "registerView"}`,
+	})
+	outFile := filepath.Join(dir, "gen", "views.ts")
+	if err := GenerateTomatoes(dir, outFile, TypeScript, testOptions(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	views := readFile(t, outFile)
+	for _, want := range []string{
+		"import { View, createView, registerView } from '../ts/view';\nimport { AriaLive } from '../ts/enums';",
+		"this.setAttr('aria-live', AriaLive.Polite)",
+		"registerView('StatusView', StatusView);",
+	} {
+		if !strings.Contains(views, want) {
+			t.Errorf("generated views are missing %q:\n%s", want, views)
+		}
+	}
+}
+
+func TestGroupedViewNameEnum(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"cart/item.htmto": `<li>item</li>`,
+		"shop/shop.htmto": `<div>shop</div>`,
+	})
+	opts := testOptions()
+	opts.GroupByDepth = 1
+	opts.EmitViewNameEnum = true
+	outFile := filepath.Join(dir, "gen", "views.ts")
+	if err := GenerateTomatoes(dir, outFile, TypeScript, opts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\nexport enum ViewName {\n  ItemView = 'ItemView',\n  ShopView = 'ShopView',\n}\n"
+	if views := readFile(t, outFile); !strings.HasSuffix(views, want) {
+		t.Errorf("views = %q, want it to end with %q", views, want)
+	}
+	for _, group := range []string{"cart.ts", "shop.ts"} {
+		if views := readFile(t, filepath.Join(dir, "gen", group)); strings.Contains(views, "enum") {
+			t.Errorf("%s has an enum of its own:\n%s", group, views)
+		}
+	}
+}
+
+func TestSingleTemplateGeneratesNestedViews(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"views/card.htmto":        `<div><tomato src="parts/item.htmto"></tomato></div>`,
+		"views/parts/item.htmto":  `<li><tomato src="label.htmto" _ref="label" _lazy></tomato></li>`,
+		"views/parts/label.htmto": `<span>label</span>`,
+		"views/other.htmto":       `<p>other</p>`,
+	})
+	opts := testOptions()
+	opts.StatementStyle = true
+	outFile := filepath.Join(dir, "gen", "views.ts")
+	if err := GenerateTomatoes(filepath.Join(dir, "views", "card.htmto"), outFile, TypeScript, opts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	views := readFile(t, outFile)
+	for _, class := range []string{"CardView", "ItemView", "LabelView"} {
+		if !strings.Contains(views, "export class "+class+" ") {
+			t.Errorf("generated views are missing %s:\n%s", class, views)
+		}
+	}
+	if strings.Contains(views, "OtherView") {
+		t.Errorf("generated views include an unreferenced template:\n%s", views)
+	}
+}
+
+func TestSingleFileMustBeATemplate(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{"card.html": `<div></div>`})
+	err := GenerateTomatoes(filepath.Join(dir, "card.html"), filepath.Join(dir, "views.ts"), TypeScript, testOptions(), false)
+	if err == nil || !strings.Contains(err.Error(), "card.html isn't a .htmto template") {
+		t.Errorf("got error %v, want one saying card.html isn't a template", err)
+	}
+}
+
+func TestTimestampAloneDoesNotRewrite(t *testing.T) {
+	tests := []struct {
+		name, template, changed string
+		rewritten               bool
+	}{
+		{"timestamp only", `<p>a</p>`, `<p>a</p>`, false},
+		{"body", `<p>a</p>`, `<p>b</p>`, true},
+		{"timestamp like body", `<p>Generated at 2001-01-01T00:00:00Z</p>`, `<p>Generated at 2002-02-02T00:00:00Z</p>`, true},
+	}
+	for _, test := range tests {
+		dir := writeTemplates(t, map[string]string{"views/card.htmto": test.template})
+		opts := testOptions()
+		opts.Header = true
+		opts.HeaderTimestamp = true
+		outFile := filepath.Join(dir, "gen", "views.ts")
+		if err := GenerateTomatoes(filepath.Join(dir, "views"), outFile, TypeScript, opts, false); err != nil {
+			t.Fatal(err)
+		}
+
+		// Backdate the timestamp, as though the file had been generated long ago.
+		generated := readFile(t, outFile)
+		backdated := headerTimestampLine.ReplaceAllString(generated, "${1}// Generated at 2000-01-01T00:00:00Z\n")
+		if backdated == generated {
+			t.Fatalf("%s: no header timestamp in\n%s", test.name, generated)
+		}
+		if err := ioutil.WriteFile(outFile, []byte(backdated), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "views", "card.htmto"), []byte(test.changed), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := GenerateTomatoes(filepath.Join(dir, "views"), outFile, TypeScript, opts, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if rewritten := readFile(t, outFile) != backdated; rewritten != test.rewritten {
+			t.Errorf("%s: rewritten = %v, want %v", test.name, rewritten, test.rewritten)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package tomatotest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/donjaime/tomato"
+)
+
+// Type checks the views generated from the compile corpus against the view library, under the option
+// combinations that change what's emitted the most. It needs tsc, so it only runs when TOMATO_TSC is
+// set: TOMATO_TSC=1 go test ./tomatotest -run Compiles
+func TestCorpusCompiles(t *testing.T) {
+	if os.Getenv("TOMATO_TSC") == "" {
+		t.Skip("set TOMATO_TSC to type check the generated views with tsc")
+	}
+
+	tests := []struct {
+		name  string
+		apply func(opts *tomato.GeneratorOptions)
+	}{
+		{"chain", func(opts *tomato.GeneratorOptions) {}},
+		{"statements", func(opts *tomato.GeneratorOptions) { opts.StatementStyle = true }},
+		{"hydrate", func(opts *tomato.GeneratorOptions) { opts.Hydrate = true }},
+		{"attrTypes", func(opts *tomato.GeneratorOptions) { opts.AttrTypes = tomato.DefaultAttrTypes }},
+		{"bulkAttrTypes", func(opts *tomato.GeneratorOptions) {
+			opts.AttrTypes = tomato.DefaultAttrTypes
+			opts.BulkAttrs = true
+		}},
+		{"appendGuards", func(opts *tomato.GeneratorOptions) {
+			opts.StatementStyle = true
+			opts.AppendGuards = true
+			opts.DevGuard = "true" // Rather than process.env, which needs Node's typings.
+		}},
+		{"bareAttrs", func(opts *tomato.GeneratorOptions) { opts.BareAttrsAsBooleans = true }},
+		{"bulkBareAttrs", func(opts *tomato.GeneratorOptions) {
+			opts.BareAttrsAsBooleans = true
+			opts.BulkAttrs = true
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := corpusOptions()
+			test.apply(opts)
+			if err := Compile("testdata/compile", opts, "../ts/view.ts"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
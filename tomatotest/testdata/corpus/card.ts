@@ -0,0 +1,14 @@
+export class CardView extends View {
+  title: View;
+  item: ItemView;
+
+  constructor(doc: Document = document) {
+    super(doc.createElement('div'));
+
+    this.setAttr('class', 'card')
+      .append(this.title = createView('h1', doc).appendText('Hello world'))
+      .append(createView('p', doc).appendText('Some ')
+        .append(createView('b', doc).appendText('bold')).appendText(' text!'))
+      .append(this.item = <ItemView>new ItemView(doc));
+  }
+}
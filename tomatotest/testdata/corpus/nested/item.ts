@@ -0,0 +1,10 @@
+export class ItemView extends View {
+  label: View;
+
+  constructor(doc: Document = document) {
+    super(doc.createElement('li'));
+
+    this.setAttr('class', 'item')
+      .append(this.label = createView('span', doc).appendText('An item'));
+  }
+}
@@ -0,0 +1,170 @@
+// Package tomatotest compares generated views against golden files, so generators (tomato's own or
+// downstream ones) can be tested against a corpus of templates.
+//
+// A corpus is a directory of .htmto templates, each with a golden file next to it holding the expected
+// view: the template's path with the extension swapped, e.g. card.htmto and card.ts.
+//
+// Compile and CheckCompiles go further and type check the generated TypeScript with tsc, which catches
+// emitted code that isn't valid TypeScript at all.
+package tomatotest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/donjaime/tomato"
+)
+
+const templateExtension = ".htmto"
+
+// Generates every template under dir (or dir itself, when it's a single template) and compares each
+// view with its golden file. Returns a description of every mismatch, or nothing when the output
+// matches. Leading and trailing whitespace is ignored.
+func Diff(dir string, language tomato.Language, opts *tomato.GeneratorOptions, goldenExtension string) ([]string, error) {
+	views, err := generate(dir, language, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, file := range sortedKeys(views) {
+		goldenFile := goldenPath(file, goldenExtension)
+		golden, err := ioutil.ReadFile(goldenFile)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: missing golden file: %v", file, err))
+			continue
+		}
+
+		if problem := firstDifference(strings.TrimSpace(views[file].ViewText), strings.TrimSpace(string(golden))); problem != "" {
+			problems = append(problems, goldenFile+":"+problem)
+		}
+	}
+	return problems, nil
+}
+
+// Runs Diff and fails t for every mismatch.
+func CheckGoldens(t testing.TB, dir string, language tomato.Language, opts *tomato.GeneratorOptions, goldenExtension string) {
+	t.Helper()
+	problems, err := Diff(dir, language, opts, goldenExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+// Rewrites the golden files from the current output. Handy after an intended change to the output.
+func UpdateGoldens(dir string, language tomato.Language, opts *tomato.GeneratorOptions, goldenExtension string) error {
+	views, err := generate(dir, language, opts)
+	if err != nil {
+		return err
+	}
+
+	for file, view := range views {
+		golden := strings.TrimSpace(view.ViewText) + "\n"
+		if err := ioutil.WriteFile(goldenPath(file, goldenExtension), []byte(golden), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returned by Compile when there is no tsc on the PATH.
+var ErrNoTsc = errors.New("tsc is not installed")
+
+// Generates every template under dir into one file and type checks it with tsc --noEmit. runtime is the
+// path of the view library the generated views import (e.g. ts/view.ts), it replaces the options'
+// ImportLocation. The error holds tsc's output when the views don't compile.
+func Compile(dir string, opts *tomato.GeneratorOptions, runtime string) error {
+	tsc, err := exec.LookPath("tsc")
+	if err != nil {
+		return ErrNoTsc
+	}
+
+	runtime, err = filepath.Abs(runtime)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "tomatotest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	compileOpts := *opts
+	compileOpts.ImportLocation = filepath.ToSlash(strings.TrimSuffix(runtime, filepath.Ext(runtime)))
+	outFile := filepath.Join(tmpDir, "views.ts")
+	if err := tomato.GenerateTomatoes(dir, outFile, tomato.TypeScript, &compileOpts, false); err != nil {
+		return err
+	}
+
+	out, err := exec.Command(tsc, "--noEmit", "--target", "es2017", "--lib", "es2017,dom", outFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("generated views don't compile: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// Runs Compile and fails t if the generated views don't compile. Skips t when tsc isn't installed, so
+// the check can live alongside the regular tests.
+func CheckCompiles(t testing.TB, dir string, opts *tomato.GeneratorOptions, runtime string) {
+	t.Helper()
+	if err := Compile(dir, opts, runtime); err == ErrNoTsc {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generate(dir string, language tomato.Language, opts *tomato.GeneratorOptions) (map[string]*tomato.View, error) {
+	files, err := tomato.CollectTomatoFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	generator, err := tomato.MakeTomatoGenerator(language, opts)
+	if err != nil {
+		return nil, err
+	}
+	return generator.GenerateViews(files, false)
+}
+
+func goldenPath(file, goldenExtension string) string {
+	return strings.TrimSuffix(file, templateExtension) + goldenExtension
+}
+
+// Describes the first line at which got and want differ, or returns "" if they're identical.
+func firstDifference(got, want string) string {
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		gotLine, wantLine := "<EOF>", "<EOF>"
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if gotLine != wantLine {
+			return fmt.Sprintf("%d: got %q, want %q", i+1, gotLine, wantLine)
+		}
+	}
+	return ""
+}
+
+func sortedKeys(views map[string]*tomato.View) []string {
+	keys := make([]string, 0, len(views))
+	for k := range views {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,72 @@
+package tomatotest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/donjaime/tomato"
+)
+
+func corpusOptions() *tomato.GeneratorOptions {
+	return &tomato.GeneratorOptions{
+		ViewBaseClass:  "View",
+		ViewFactory:    "createView",
+		ImportLocation: "../ts/view",
+		Logger:         &tomato.Logger{Out: ioutil.Discard},
+	}
+}
+
+func TestCorpusMatchesGoldens(t *testing.T) {
+	CheckGoldens(t, "testdata/corpus", tomato.TypeScript, corpusOptions(), ".ts")
+}
+
+func TestDiffSingleTemplate(t *testing.T) {
+	problems, err := Diff("testdata/corpus/nested/item.htmto", tomato.TypeScript, corpusOptions(), ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+func TestDiffReportsMismatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tomatotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "btn.htmto")
+	if err := ioutil.WriteFile(template, []byte(`<a class="btn">hi</a>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Diff(dir, tomato.TypeScript, corpusOptions(), ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "missing golden file") {
+		t.Fatalf("Diff without a golden file = %q, want a missing golden file", problems)
+	}
+
+	if err := UpdateGoldens(dir, tomato.TypeScript, corpusOptions(), ".ts"); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := Diff(dir, tomato.TypeScript, corpusOptions(), ".ts"); err != nil || len(problems) != 0 {
+		t.Fatalf("Diff after UpdateGoldens = %q, %v, want no problems", problems, err)
+	}
+
+	if err := ioutil.WriteFile(template, []byte(`<a class="btn">bye</a>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = Diff(dir, tomato.TypeScript, corpusOptions(), ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "btn.ts:") {
+		t.Fatalf("Diff after changing the template = %q, want a mismatch in btn.ts", problems)
+	}
+}
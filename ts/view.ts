@@ -2,6 +2,13 @@ export function createView(t: string, doc: Document = document): View {
   return new View(doc.createElement(t));
 }
 
+/**
+ * A View over a DocumentFragment, for building up many children and then appending them all at once.
+ */
+export function createFragment(doc: Document = document): View {
+  return new View(doc.createDocumentFragment() as any as HTMLElement);
+}
+
 export function selectView(sel: string): View | null {
   const e = document.querySelector(sel);
   return e ? new View(e as HTMLElement) : null;
@@ -91,6 +98,13 @@ export class View {
     return this;
   }
 
+  setAttrs(attrs: { [k: string]: string }): View {
+    for (const k in attrs) {
+      setAttr(this.e, k, attrs[k]);
+    }
+    return this;
+  }
+
   prop(k: string): any {
     return prop(this.e, k);
   }
@@ -445,6 +459,16 @@ export function append(e: Node | View, o: Node | View) {
   en.appendChild(on);
 }
 
+/**
+ * Throws when o already has a parent, which appending it elsewhere would silently take it away from.
+ */
+export function assertDetached(o: Node | View) {
+  const on: Node = (o instanceof View) ? o.e : o;
+  if (on.parentNode) {
+    throw new Error('<' + on.nodeName.toLowerCase() + '> is already attached, append it to one parent only');
+  }
+}
+
 export function prepend(e: Node | View, o: Node | View) {
   const en: Node = (e instanceof View) ? e.e : e,
       on: Node = (o instanceof View) ? o.e : o;